@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/reddec/amqp-utils/common"
+	"github.com/streadway/amqp"
+)
+
+// Batch options
+var (
+	batchMode   = app.Flag("batch", "Read many requests from stdin separated by --sep and wait for all replies").Short('b').Bool()
+	sep         = app.Flag("sep", "Request separator in batch mode").Default("\n").String()
+	zero        = app.Flag("0", "Zero separator in batch mode").Short('0').Bool()
+	maxInflight = app.Flag("max-inflight", "Maximum number of requests waiting for reply in batch mode").Default("16").Int()
+	order       = app.Flag("order", "Order of batch results: input or completion").Default("input").Enum("input", "completion")
+)
+
+// batchResult is a single reply of batch in JSON mode
+type batchResult struct {
+	Index         int             `json:"index"`
+	CorrelationId string          `json:"correlation_id"`
+	Error         string          `json:"error,omitempty"`
+	Reply         *common.Message `json:"reply,omitempty"`
+}
+
+// batch sends every separated request from stdin keeping no more than --max-inflight without reply. Each request
+// has own timeout. Failed requests are reported, but do not stop batch
+func batch(ctx context.Context, client *common.RPCClient) error {
+	frames := common.NewFrameReader(os.Stdin, common.FramingDelimiter, *sep)
+	results := make(chan *batchResult, *maxInflight)
+	slots := make(chan struct{}, *maxInflight)
+	var wg sync.WaitGroup
+	var readErr error
+	index := 0
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		for ctx.Err() == nil {
+			data, err := frames.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(index int, msg amqp.Publishing) {
+				defer wg.Done()
+				reply, err := client.Call(ctx, msg)
+				<-slots
+				res := &batchResult{Index: index, CorrelationId: msg.CorrelationId}
+				if err == context.DeadlineExceeded {
+					err = errors.New("timeout")
+				}
+				if err != nil {
+					res.Error = err.Error()
+				}
+				if reply.CorrelationId != "" {
+					message := common.FromDelivery(reply)
+					res.Reply = &message
+				}
+				results <- res
+			}(index, request(data))
+			index++
+		}
+	}()
+
+	ready := make(map[int]*batchResult)
+	next := 0
+	failed := 0
+	var writeErr error
+	emit := func(res *batchResult) error {
+		if res.Error != "" {
+			log.Println("Request", res.Index, "with correlation id", res.CorrelationId, "failed:", res.Error)
+			failed++
+		}
+		if *order == "completion" {
+			return writeResult(res)
+		}
+		ready[res.Index] = res
+		for {
+			res, ok := ready[next]
+			if !ok {
+				return nil
+			}
+			delete(ready, next)
+			next++
+			if err := writeResult(res); err != nil {
+				return err
+			}
+		}
+	}
+	// results are drained even after write failure, so no request is left blocked
+	for res := range results {
+		if writeErr == nil {
+			writeErr = emit(res)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if readErr != nil {
+		return readErr
+	}
+	log.Println("Processed", index, "requests,", failed, "failed")
+	if failed > 0 {
+		return errors.Errorf("%v of %v requests failed", failed, index)
+	}
+	return ctx.Err()
+}
+
+// writeResult prints one batch result. In raw mode failed request produces empty body to keep position in output
+func writeResult(res *batchResult) error {
+	switch *format {
+	case "raw":
+		if res.Error == "" {
+			if _, err := os.Stdout.Write([]byte(res.Reply.Body)); err != nil {
+				return err
+			}
+		}
+		_, err := os.Stdout.Write([]byte(*sep))
+		return err
+	case "json":
+		return json.NewEncoder(os.Stdout).Encode(res)
+	default:
+		panic("Unknown message format")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
@@ -8,10 +9,10 @@ import (
 
 	"github.com/satori/go.uuid"
 	"github.com/streadway/amqp"
+	"github.com/reddec/amqp-utils/common"
 	"github.com/alecthomas/kingpin"
 	"fmt"
 	"github.com/pkg/errors"
-	"io"
 	"encoding/json"
 )
 
@@ -23,115 +24,129 @@ var (
 	exchange     = app.Flag("exchange", "Exchange name").Short('e').Default("amq.topic").String()
 	exchangeType = app.Flag("exchange-type", "Exchange type if create").Default("topic").Enum("topic", "direct")
 	passive      = app.Flag("passive", "Do not try to create infrastructure").Short('p').Bool()
+	topology     = app.Flag("topology", "YAML file with topology (exchanges, queues, binds) to declare").ExistingFile()
 	quiet        = app.Flag("quiet", "Disable verbose logging").Bool()
 	key          = app.Arg("routing-key", "Routing key to publish").String()
 )
 
-var realQueue = ""
+var replied = errors.New("Reply received")
 
-func createInfrastructure(channel *amqp.Channel) error {
-	log.Println("Checking exchange", *exchange, "type", *exchangeType)
-	err := channel.ExchangeDeclare(*exchange, *exchangeType, true, false, false, false, nil)
-
-	q, err := channel.QueueDeclare("", false, true, true, false, nil)
-	if err != nil {
-		return err
+// newClient configures RPC client. Exchange (and topology) is declared unless passive mode. Call is not retried, so
+// reconnect is disabled
+func newClient() (*common.RPCClient, error) {
+	client := &common.RPCClient{
+		Connection:  common.Connection{URL: *brokerUrl, Reconnect: common.Reconnect{Disable: true}},
+		RoutingKey:  *key,
+		Timeout:     *timeout,
+		DirectReply: *directReply,
 	}
-	realQueue = q.Name
-	log.Println("Created temprorary queue", realQueue)
-	return err
+	client.Exchange = common.Exchange{Name: *exchange, Type: *exchangeType, Durable: true, Passive: *passive}
+	if *topology != "" && !*passive {
+		err := common.Read(*topology, &client.Topology)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client.Init()
+	return client, nil
 }
 
 func run() error {
-	log.Println("Connecting")
-	conn, err := amqp.Dial(*brokerUrl)
+	client, err := newClient()
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	log.Println("Opening channel")
-	channel, err := conn.Channel()
-	if err != nil {
-		return err
-	}
-	defer channel.Close()
-	if !*passive {
-		log.Println("Creating infrastructure if required")
-		err = createInfrastructure(channel)
-		if err != nil {
-			return err
-		}
+	ctx := common.SignalContext()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+	if *batchMode {
+		err = batch(ctx, client)
 	} else {
-		log.Println("Skip check infrastructure")
+		err = call(ctx, client)
 	}
-
-	return consumeAndSend(channel)
+	client.Close()
+	runErr := <-done
+	if err == common.RPCClientStopped && runErr != nil {
+		// connection failed: report the reason
+		return runErr
+	}
+	return err
 }
 
 // Specific options
 var (
-	name            = app.Flag("app", "Producer and consumer name (app name)").Default(defApp()).Short('a').String()
+	name            = app.Flag("app", "Producer name (app name)").Default(defApp()).Short('a').String()
 	headers         = app.Flag("header", "Additional headers").Short('h').StringMap()
 	timeout         = app.Flag("timeout", "Request timeout").Short('t').Default("30s").Duration()
+	idleTimeout     = app.Flag("idle-timeout", "Maximum time between stream replies (0 - only total timeout)").Default("0").Duration()
+	streamReplies   = app.Flag("stream", "Print multiple replies until reply with "+common.StreamEndHeader+" header").Short('s').Bool()
 	contentType     = app.Flag("content-type", "Content type of message body").String()
 	contentEncoding = app.Flag("content-encoding", "Content encoding of body").String()
 	format          = app.Flag("format", "Output format").Default("raw").Enum("json", "raw")
+	directReply     = app.Flag("direct-reply", "Use RabbitMQ direct reply-to instead of temporary queue").Short('d').Bool()
 )
 
-func sendMessage(channel *amqp.Channel, data []byte) error {
+// request with body and properties from flags. Reply queue is set by client
+func request(data []byte) amqp.Publishing {
 	mheaders := map[string]interface{}{}
 	for k, v := range *headers {
 		mheaders[k] = v
 	}
-	corrId := uuid.NewV4().String()
-	msg := amqp.Publishing{
+	return amqp.Publishing{
 		Body:            data,
 		Headers:         mheaders,
 		Timestamp:       time.Now(),
 		MessageId:       uuid.NewV4().String(),
 		AppId:           *name,
-		CorrelationId:   corrId,
+		CorrelationId:   uuid.NewV4().String(),
 		ContentType:     *contentType,
 		ContentEncoding: *contentEncoding,
-		ReplyTo:         realQueue,
-	}
-	log.Println("Sending", msg.MessageId)
-	err := channel.Publish(*exchange, *key, false, false, msg)
-	if err != nil {
-		return err
 	}
-	log.Println("Sent message", msg.MessageId)
-	return nil
 }
 
-func consumeAndSend(channel *amqp.Channel) error {
+// call sends whole stdin as one request and prints reply (or all replies in stream mode)
+func call(ctx context.Context, client *common.RPCClient) error {
 	log.Println("Waiting for EOF")
 	data, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		return err
 	}
-	err = sendMessage(channel, data)
-	if err != nil {
-		return err
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var idle *time.Timer
+	if *idleTimeout > 0 {
+		idle = time.AfterFunc(*idleTimeout, cancel)
 	}
-	stream, err := channel.Consume(realQueue, *name, true, true, false, false, nil)
-	if err != nil {
-		return err
-	}
-	select {
-	case msg, ok := <-stream:
-		if !ok {
-			return io.EOF
+	msg := request(data)
+	log.Println("Sending", msg.MessageId)
+	err = client.Stream(ctx, msg, func(reply amqp.Delivery) error {
+		if idle != nil {
+			idle.Reset(*idleTimeout)
 		}
-		if msg.Headers != nil {
-			if ert, ok := msg.Headers["error"]; ok {
-				return errors.New(ert.(string))
-			}
+		if common.ReplyError(reply) != nil {
+			// returned by stream
+			return nil
 		}
-		return dumpMessage(msg)
-	case <-time.After(*timeout):
+		err := dumpMessage(reply)
+		if err != nil {
+			return err
+		}
+		if !*streamReplies {
+			return replied
+		}
+		return nil
+	})
+	switch {
+	case err == replied:
+		return nil
+	case err == context.DeadlineExceeded:
 		return errors.New("timeout")
+	case err == context.Canceled && idle != nil && !idle.Stop():
+		return errors.New("idle timeout")
 	}
+	return err
 }
 
 func dumpMessage(msg amqp.Delivery) error {
@@ -162,6 +177,15 @@ func main() {
 	} else {
 		log.SetOutput(os.Stderr)
 	}
+	if *zero {
+		*sep = "\000"
+	}
+	if *batchMode && *streamReplies {
+		kingpin.Fatalf("--batch and --stream can not be used together")
+	}
+	if *maxInflight < 1 {
+		*maxInflight = 1
+	}
 	var err error
 	err = run()
 	if err != nil {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/reddec/amqp-utils/common"
+	"github.com/streadway/amqp"
+)
+
+// Filter options
+var (
+	where            = app.Flag("where", "(Repeated) Filter expression: <field> == \"value\", !=, =~ (regexp), !~ or just <field> (not empty). Fields are from JSON of message: headers.<name>, routing_key, type, ...").Strings()
+	keyGlob          = app.Flag("key-glob", "Print only messages with routing key matched glob (ex: orders.*.created)").String()
+	contentTypeGlob  = app.Flag("content-type", "Print only messages with content type matched glob (ex: application/*)").String()
+	bodyRegexp       = app.Flag("body-regexp", "Print only messages with body matched regexp").Regexp()
+	requeueUnmatched = app.Flag("requeue-unmatched", "Keep skipped messages unacknowledged (returned to queue on exit) instead of ack").Bool()
+)
+
+var expressionPattern = regexp.MustCompile(`^\s*([\w.\-]+)\s*(?:(==|!=|=~|!~)\s*(.*?))?\s*$`)
+
+// condition is parsed --where expression
+type condition struct {
+	field    []string
+	operator string
+	value    string
+	pattern  *regexp.Regexp
+}
+
+var conditions []condition
+
+// initFilter parses --where expressions
+func initFilter() error {
+	if _, err := path.Match(*keyGlob, ""); err != nil {
+		return errors.Wrap(err, "key glob")
+	}
+	if _, err := path.Match(*contentTypeGlob, ""); err != nil {
+		return errors.Wrap(err, "content type glob")
+	}
+	for _, expr := range *where {
+		parts := expressionPattern.FindStringSubmatch(expr)
+		if parts == nil {
+			return errors.Errorf("invalid expression %q", expr)
+		}
+		cond := condition{field: strings.Split(parts[1], "."), operator: parts[2], value: parts[3]}
+		if strings.HasPrefix(cond.value, "\"") {
+			value, err := strconv.Unquote(cond.value)
+			if err != nil {
+				return errors.Wrapf(err, "expression %q", expr)
+			}
+			cond.value = value
+		}
+		if cond.operator == "=~" || cond.operator == "!~" {
+			pattern, err := regexp.Compile(cond.value)
+			if err != nil {
+				return errors.Wrapf(err, "expression %q", expr)
+			}
+			cond.pattern = pattern
+		}
+		conditions = append(conditions, cond)
+	}
+	return nil
+}
+
+// matches checks message against all filters
+func matches(msg amqp.Delivery) bool {
+	if *keyGlob != "" {
+		if ok, _ := path.Match(*keyGlob, msg.RoutingKey); !ok {
+			return false
+		}
+	}
+	if *contentTypeGlob != "" {
+		if ok, _ := path.Match(*contentTypeGlob, msg.ContentType); !ok {
+			return false
+		}
+	}
+	if *bodyRegexp != nil && !(*bodyRegexp).Match(msg.Body) {
+		return false
+	}
+	if len(conditions) == 0 {
+		return true
+	}
+	// JSON view of message is used to resolve fields the same way as in ndjson output
+	var fields map[string]interface{}
+	data, err := json.Marshal(common.FromDelivery(msg))
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	if err != nil {
+		return false
+	}
+	for _, cond := range conditions {
+		if !cond.matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cond *condition) matches(fields map[string]interface{}) bool {
+	var value interface{} = fields
+	for _, name := range cond.field {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			value = nil
+			break
+		}
+		value = obj[name]
+	}
+	text := common.HeaderString(value)
+	switch cond.operator {
+	case "==":
+		return value != nil && text == cond.value
+	case "!=":
+		return value == nil || text != cond.value
+	case "=~":
+		return value != nil && cond.pattern.MatchString(text)
+	case "!~":
+		return value == nil || !cond.pattern.MatchString(text)
+	default:
+		return value != nil && text != ""
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func setFilter(t *testing.T, expressions ...string) {
+	t.Helper()
+	*where = expressions
+	conditions = nil
+	if err := initFilter(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	msg := amqp.Delivery{
+		RoutingKey: "orders.created",
+		Type:       "order",
+		Headers:    amqp.Table{"tenant": "acme", "attempt": int32(2), "empty": ""},
+	}
+	cases := []struct {
+		expression string
+		match      bool
+	}{
+		{`routing_key == "orders.created"`, true},
+		{`routing_key == orders.created`, true},
+		{`routing_key != "orders.created"`, false},
+		{`type=="order"`, true},
+		{`headers.tenant == "acme"`, true},
+		{`headers.tenant == "other"`, false},
+		{`headers.attempt == 2`, true},
+		{`headers.tenant =~ "^ac"`, true},
+		{`headers.tenant !~ "^ac"`, false},
+		{`headers.tenant`, true},
+		{`headers.empty`, false},
+		// missing field
+		{`headers.missing`, false},
+		{`headers.missing == ""`, false},
+		{`headers.missing != "acme"`, true},
+		{`headers.missing !~ "."`, true},
+		{`headers.tenant.nested`, false},
+		{`headers.tenant == "with \"quotes\""`, false},
+	}
+	for _, c := range cases {
+		setFilter(t, c.expression)
+		if got := matches(msg); got != c.match {
+			t.Errorf("%v: got %v, want %v", c.expression, got, c.match)
+		}
+	}
+	// all expressions should match
+	setFilter(t, `type == "order"`, `headers.tenant == "other"`)
+	if matches(msg) {
+		t.Error("message matched only one of expressions")
+	}
+}
+
+func TestWhereInvalid(t *testing.T) {
+	for _, expression := range []string{``, `a > 1`, `a =~ "("`, `a == "unterminated`} {
+		*where = []string{expression}
+		conditions = nil
+		if err := initFilter(); err == nil {
+			t.Errorf("%q accepted", expression)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"text/template"
+
+	"github.com/reddec/amqp-utils/common"
+	"github.com/streadway/amqp"
+)
+
+// out buffers stdout: message is acknowledged only after output flushed
+var out = bufio.NewWriter(os.Stdout)
+var firstMessage = true
+var frames *common.FrameWriter
+var csvWriter *csv.Writer
+var templ *template.Template
+
+// initFormat prepares output for selected format: parses template, prints CSV header
+func initFormat() error {
+	if *format != "raw" && *framing != common.FramingDelimiter {
+		return errors.New("--framing can be used only with raw format")
+	}
+	frames = common.NewFrameWriter(out, *framing, *sep)
+	switch *format {
+	case "template":
+		if *templateFile == "" {
+			return errors.New("--template is required for template format")
+		}
+		t, err := template.ParseFiles(*templateFile)
+		if err != nil {
+			return err
+		}
+		templ = t
+	case "csv":
+		csvWriter = csv.NewWriter(out)
+		if *csvHeader {
+			err := csvWriter.Write(common.MessageHeaders())
+			if err != nil {
+				return err
+			}
+			csvWriter.Flush()
+			if err = csvWriter.Error(); err != nil {
+				return err
+			}
+			return out.Flush()
+		}
+	}
+	return nil
+}
+
+// finishFormat ends output: raw output is terminated by separator if the last message is empty
+func finishFormat() error {
+	if *format != "raw" {
+		return nil
+	}
+	err := frames.Close()
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// dumpMessage writes message and flushes output
+func dumpMessage(msg amqp.Delivery) error {
+	err := writeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// writeMessage writes message in selected format. Line-oriented formats (ndjson, csv) ignore separator, raw bodies are
+// written with selected framing
+func writeMessage(msg amqp.Delivery) error {
+	switch *format {
+	case "ndjson":
+		return json.NewEncoder(out).Encode(common.FromDelivery(msg))
+	case "csv":
+		message := common.FromDelivery(msg)
+		columns, err := message.Columns()
+		if err != nil {
+			return err
+		}
+		err = csvWriter.Write(columns)
+		if err != nil {
+			return err
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	case "raw":
+		return frames.Write(msg.Body)
+	}
+	var err error
+	if !firstMessage {
+		_, err = out.WriteString(*sep)
+		if err != nil {
+			return err
+		}
+	} else {
+		firstMessage = false
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		err = enc.Encode(msg)
+	case "template":
+		err = templ.Execute(out, common.FromDelivery(msg))
+	case "hex":
+		_, err = out.Write([]byte(hex.Dump(msg.Body)))
+	case "base64":
+		_, err = out.Write([]byte(base64.StdEncoding.EncodeToString(msg.Body)))
+	default:
+		panic("Unknown message format")
+	}
+	return err
+}
@@ -7,10 +7,12 @@ import (
 	"time"
 
 	"github.com/streadway/amqp"
+	"github.com/reddec/amqp-utils/common"
 	"github.com/alecthomas/kingpin"
 	"fmt"
-	"encoding/json"
 	"io"
+	"context"
+	"github.com/pkg/errors"
 )
 
 var app = kingpin.New("amqp-cat", "Read data from AMQP broker")
@@ -27,6 +29,7 @@ var (
 	once              = app.Flag("once", "Do not reconnect to AMQP").Bool()
 	lazy              = app.Flag("lazy", "Lazy queue (RabbitMQ only)").Short('l').Bool()
 	reconnectInterval = app.Flag("interval", "Reconnect interval").Short('w').Default("3s").Duration()
+	topology          = app.Flag("topology", "YAML file with topology (exchanges, queues, binds) to declare").ExistingFile()
 	quiet             = app.Flag("quiet", "Disable verbose logging").Short('v').Bool()
 	keys              = app.Arg("routing-key", "Routing keys to bind").Strings()
 )
@@ -34,31 +37,42 @@ var (
 var realQueue = ""
 
 func createInfrastructure(channel *amqp.Channel) error {
-	log.Println("Checking exchange", *exchange, "type", *exchangeType)
-	err := channel.ExchangeDeclare(*exchange, *exchangeType, true, false, false, false, nil)
+	if *topology != "" {
+		var infrastructure common.Infrastructure
+		err := common.Read(*topology, &infrastructure)
+		if err != nil {
+			return err
+		}
+		err = infrastructure.Create(channel)
+		if err != nil {
+			return err
+		}
+	}
+	ex := common.Exchange{Name: *exchange, Type: *exchangeType, Durable: true}
+	err := ex.Create(channel)
+	if err != nil {
+		return err
+	}
 	autoDelete := *removeQueue || *queue == ""
 	log.Println("Checking queue (auto-delete -", autoDelete, ")")
-	args := make(amqp.Table)
-	if *lazy {
-		args["x-queue-mode"] = "lazy"
+	q := common.Queue{
+		Name:       *queue,
+		Durable:    true,
+		AutoDelete: autoDelete,
+		Exclusive:  *exclusive,
+		Lazy:       *lazy,
+		Binding:    map[string][]string{*exchange: *keys},
 	}
-	q, err := channel.QueueDeclare(*queue, true, autoDelete, *exclusive, false, args)
+	err = q.Create(channel)
 	if err != nil {
 		return err
 	}
-	realQueue = q.Name
+	realQueue = q.RealName()
 	log.Println("Queue is", realQueue)
-	for _, key := range *keys {
-		log.Println("Bindingig queue with key", key)
-		err = channel.QueueBind(realQueue, key, *exchange, false, nil)
-		if err != nil {
-			return err
-		}
-	}
-	return err
+	return nil
 }
 
-func run() error {
+func run(ctx context.Context) error {
 	log.Println("Connecting")
 	conn, err := amqp.Dial(*brokerUrl)
 	if err != nil {
@@ -71,6 +85,9 @@ func run() error {
 		return err
 	}
 	defer channel.Close()
+	if *peek > 0 {
+		return peekMessages(conn, channel)
+	}
 	if !*passive {
 		log.Println("Creating infrastructure if required")
 		err = createInfrastructure(channel)
@@ -80,63 +97,128 @@ func run() error {
 	} else {
 		log.Println("Skip check infrastructure")
 	}
-	return receiveMessages(channel)
+	return receiveMessages(ctx, channel)
 }
 
 // Specific options
 var (
-	name   = app.Flag("app", "Consumer name (app name)").Default(defApp()).Short('a').String()
-	single = app.Flag("single", "Consume only one message").Short('1').Bool()
-	sep    = app.Flag("sep", "Message separator").Default("\n").String()
-	zero   = app.Flag("0", "Zero separator").Short('0').Bool()
-	format = app.Flag("format", "Output format").Default("raw").Enum("json", "raw")
+	name         = app.Flag("app", "Consumer name (app name)").Default(defApp()).Short('a').String()
+	single       = app.Flag("single", "Consume only one message (same as --count 1)").Short('1').Bool()
+	count        = app.Flag("count", "Stop after N messages (0 - unlimited)").Short('n').Int()
+	maxDuration  = app.Flag("max-duration", "Stop after duration (0 - unlimited)").Duration()
+	idleTimeout  = app.Flag("idle-timeout", "Stop if no messages during timeout (0 - wait forever)").Duration()
+	sep          = app.Flag("sep", "Message separator (can be multi-byte)").Default("\n").String()
+	framing      = app.Flag("framing", "Framing of raw bodies: delimiter (--sep), varint or length (4-byte big-endian) prefixed, base64 per line").Default(common.FramingDelimiter).Enum(common.Framings...)
+	zero         = app.Flag("0", "Zero separator").Short('0').Bool()
+	format       = app.Flag("format", "Output format: raw body, json (delivery), ndjson (message per line), csv, template, hex, base64").Default("raw").Enum("json", "raw", "ndjson", "csv", "template", "hex", "base64")
+	templateFile = app.Flag("template", "Go template file for template format (fields of common.Message)").ExistingFile()
+	csvHeader    = app.Flag("csv-header", "Print column names before messages in csv format").Bool()
+	peek         = app.Flag("peek", "Print first N messages of existing --queue without consuming them").Int()
+	prefetch     = app.Flag("prefetch", "Maximum unacknowledged messages with --requeue-unmatched: stop with error when so many skipped messages are held (0 - unlimited)").Default("100").Int()
 )
 
-func receiveMessages(channel *amqp.Channel) error {
+// Exit codes
+const (
+	exitOK         = 0 // --count reached or interrupted
+	exitError      = 1
+	exitNoMessages = 2 // time limit reached without messages
+	exitTimeLimit  = 3 // time limit reached after some messages
+)
+
+var NoMessages = errors.New("no messages")
+var TimeLimit = errors.New("time limit reached")
+var TooManyHeld = errors.New("prefetch limit reached by skipped messages")
+
+// received messages over all reconnects
+var received = 0
+
+// held unmatched messages of current channel
+var held = 0
+
+// receiveMessages prints messages until count or time limits. Message is acknowledged only after output flushed, so
+// unprinted messages are returned to queue when channel closed
+func receiveMessages(ctx context.Context, channel *amqp.Channel) error {
 	log.Println("Start receiveing messages")
-	stream, err := channel.Consume(realQueue, *name, false, *exclusive, false, false, nil)
-	if err != nil {
-		return err
-	}
-	for msg := range stream {
-		err = msg.Ack(false)
+	if *requeueUnmatched && *prefetch > 0 {
+		err := channel.Qos(*prefetch, 0, false)
 		if err != nil {
 			return err
 		}
-		err = dumpMessage(msg)
-		if err != nil {
-			return err
-		}
-		if *single {
-			return nil
+	}
+	held = 0
+	stream, err := common.ConsumeContext(ctx, channel, realQueue, *name, false, *exclusive)
+	if err != nil {
+		return err
+	}
+	// idle timer is restarted only by printed messages
+	var idle <-chan time.Time
+	resetIdle := func() {
+		if *idleTimeout > 0 {
+			idle = time.After(*idleTimeout)
 		}
 	}
-	if err == nil {
-		err = io.EOF
+	resetIdle()
+	for {
+		select {
+		case msg, ok := <-stream:
+			if !ok {
+				if ctx.Err() != nil {
+					return stopReason(ctx)
+				}
+				return io.EOF
+			}
+			if !matches(msg) {
+				if *requeueUnmatched {
+					// nack with requeue would redeliver it to this consumer again: it is returned when channel closed
+					held++
+					if held == *prefetch {
+						// broker delivers nothing more until held messages are returned
+						return TooManyHeld
+					}
+					continue
+				}
+				err = msg.Ack(false)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			resetIdle()
+			err = dumpMessage(msg)
+			if err != nil {
+				return err
+			}
+			err = msg.Ack(false)
+			if err != nil {
+				return err
+			}
+			received++
+			if *count > 0 && received >= *count {
+				return nil
+			}
+		case <-idle:
+			log.Println("Idle timeout")
+			return limitReached()
+		case <-ctx.Done():
+			return stopReason(ctx)
+		}
 	}
-	return err
 }
 
-var firstMessage = true
+// stopReason is nil if interrupted by signal or time limit error if --max-duration reached
+func stopReason(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Println("Max duration reached")
+		return limitReached()
+	}
+	return nil
+}
 
-func dumpMessage(msg amqp.Delivery) error {
-	var err error
-	if !firstMessage {
-		print(*sep)
-	} else {
-		firstMessage = false
-	}
-	switch *format {
-	case "raw":
-		_, err = os.Stdout.Write(msg.Body)
-	case "json":
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "    ")
-		err = enc.Encode(msg)
-	default:
-		panic("Unknown message format")
+func limitReached() error {
+	if received == 0 {
+		return NoMessages
 	}
-	return err
+	return TimeLimit
 }
 
 func defApp() string {
@@ -155,18 +237,47 @@ func main() {
 	} else {
 		log.SetOutput(os.Stderr)
 	}
+	if *peek > 0 && *queue == "" {
+		kingpin.Fatalf("--peek requires --queue")
+	}
+	if *peek > 0 {
+		*once = true
+	}
+	if *single {
+		*count = 1
+	}
+	kingpin.FatalIfError(initFormat(), "output format")
+	kingpin.FatalIfError(initFilter(), "filter")
+	ctx := common.SignalContext()
+	if *maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxDuration)
+		defer cancel()
+	}
 	var err error
 	for {
-		err = run()
-		if *once || err == nil {
+		err = run(ctx)
+		if *once || err == nil || err == NoMessages || err == TimeLimit || err == TooManyHeld || ctx.Err() != nil {
 			break
 		}
 		log.Println("Error", err, "- waiting", *reconnectInterval)
-		time.Sleep(*reconnectInterval)
+		select {
+		case <-time.After(*reconnectInterval):
+		case <-ctx.Done():
+		}
 	}
-	if err != nil {
-		os.Exit(1)
-	} else {
-		os.Exit(0)
+	if closeErr := finishFormat(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	switch err {
+	case nil:
+		os.Exit(exitOK)
+	case NoMessages:
+		os.Exit(exitNoMessages)
+	case TimeLimit:
+		os.Exit(exitTimeLimit)
+	default:
+		log.Println("Error", err)
+		os.Exit(exitError)
 	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/reddec/amqp-utils/common"
+	"github.com/streadway/amqp"
+)
+
+// peekMessages prints first messages of existing queue without consuming them: messages are fetched by basic.get
+// without ack and returned to queue by one nack. Requeued messages keep their position but marked as redelivered.
+// Filters are applied to fetched messages, so less than N messages may be printed
+func peekMessages(conn *amqp.Connection, channel *amqp.Channel) error {
+	q := common.Queue{Name: *queue}
+	info, err := q.Inspect(conn)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return errors.Errorf("queue %v not found", *queue)
+	}
+	fmt.Fprintln(os.Stderr, "Queue", info.Name, "has", info.Messages, "messages and", info.Consumers, "consumers")
+	var last *amqp.Delivery
+	for i := 0; i < *peek && err == nil; i++ {
+		msg, ok, getErr := channel.Get(info.Name, false)
+		if getErr != nil {
+			return getErr
+		}
+		if !ok {
+			break
+		}
+		last = &msg
+		if matches(msg) {
+			err = dumpMessage(msg)
+		}
+	}
+	if last == nil {
+		log.Println("Queue is empty")
+		return err
+	}
+	nackErr := last.Nack(true, true)
+	if err != nil {
+		return err
+	}
+	return nackErr
+}
@@ -8,12 +8,17 @@ import (
 	"os/exec"
 	"time"
 
-	"github.com/satori/go.uuid"
 	"github.com/streadway/amqp"
+	"github.com/reddec/amqp-utils/common"
 	"io/ioutil"
 	"io"
 	"github.com/alecthomas/kingpin"
 	"strings"
+	"context"
+	"sync"
+	"hash/fnv"
+	"github.com/pkg/errors"
+	"encoding/json"
 )
 
 var app = kingpin.New("amqp-cgi", "Read data from AMQP broker and execute script")
@@ -30,38 +35,52 @@ var (
 	once              = app.Flag("once", "Do not reconnect to AMQP").Bool()
 	lazy              = app.Flag("lazy", "Lazy queue (RabbitMQ only)").Short('l').Bool()
 	reconnectInterval = app.Flag("interval", "Reconnect interval").Short('w').Default("3s").Duration()
+	drainTimeout      = app.Flag("drain-timeout", "Time to finish running script on shutdown before kill").Default("30s").Duration()
+	topology          = app.Flag("topology", "YAML file with topology (exchanges, queues, binds) to declare").ExistingFile()
 	quiet             = app.Flag("quiet", "Disable verbose logging").Short('v').Bool()
 	keys              = app.Flag("routing-key", "Routing keys to bind").Short('k').Strings()
+	metricsListen     = app.Flag("metrics-listen", "Address to expose Prometheus metrics on /metrics (ex: :9100)").String()
 )
 
 var realQueue = ""
 
 func createInfrastructure(channel *amqp.Channel) error {
-	log.Println("Checking exchange", *exchange, "type", *exchangeType)
-	err := channel.ExchangeDeclare(*exchange, *exchangeType, true, false, false, false, nil)
+	if *topology != "" {
+		var infrastructure common.Infrastructure
+		err := common.Read(*topology, &infrastructure)
+		if err != nil {
+			return err
+		}
+		err = infrastructure.Create(channel)
+		if err != nil {
+			return err
+		}
+	}
+	ex := common.Exchange{Name: *exchange, Type: *exchangeType, Durable: true}
+	err := ex.Create(channel)
+	if err != nil {
+		return err
+	}
 	autoDelete := *removeQueue || *queue == ""
 	log.Println("Checking queue (auto-delete -", autoDelete, ")")
-	args := make(amqp.Table)
-	if *lazy {
-		args["x-queue-mode"] = "lazy"
+	q := common.Queue{
+		Name:       *queue,
+		Durable:    true,
+		AutoDelete: autoDelete,
+		Exclusive:  *exclusive,
+		Lazy:       *lazy,
+		Binding:    map[string][]string{*exchange: *keys},
 	}
-	q, err := channel.QueueDeclare(*queue, true, autoDelete, *exclusive, false, args)
+	err = q.Create(channel)
 	if err != nil {
 		return err
 	}
-	realQueue = q.Name
+	realQueue = q.RealName()
 	log.Println("Queue is", realQueue)
-	for _, key := range *keys {
-		log.Println("Bindingig queue with key", key)
-		err = channel.QueueBind(realQueue, key, *exchange, false, nil)
-		if err != nil {
-			return err
-		}
-	}
-	return err
+	return nil
 }
 
-func run() error {
+func run(ctx context.Context) error {
 	log.Println("Connecting")
 	conn, err := amqp.Dial(*brokerUrl)
 	if err != nil {
@@ -83,81 +102,194 @@ func run() error {
 	} else {
 		log.Println("Skip check infrastructure")
 	}
-	return receiveMessages(channel)
+	return receiveMessages(ctx, conn, channel)
 }
 
 // Specific options
 var (
 	name          = app.Flag("app", "Consumer name (app name)").Default(defApp()).Short('a').String()
 	single        = app.Flag("single", "Consume only one message").Short('1').Bool()
-	errorStrategy = app.Flag("fail", "Action if non-zero exit code").Short('f').Default("reply").Enum("drop", "restart", "stop", "reply")
+	errorStrategy = app.Flag("fail", "Action if non-zero exit code").Short('f').Default("reply").Enum("drop", "restart", "stop", "reply", "retry")
+	workers       = app.Flag("workers", "Number of scripts running concurrently").Short('n').Default("1").Int()
+	prefetch      = app.Flag("prefetch", "Maximum unacknowledged messages from broker (0 - same as workers)").Default("0").Int()
+	orderBy       = app.Flag("order-by", "Keep order of messages with same key: routing-key, correlation-id or header:<name>").String()
+	execTimeout   = app.Flag("exec-timeout", "Kill script (with all children) after timeout (0 - no limit)").Default("0").Duration()
+	maxOutput     = app.Flag("max-output", "Maximum size of script output (0 - no limit), e.g. 16MB").Default("0").Bytes()
+	stderrCapture = app.Flag("stderr-capture", "Capture first bytes of stderr into failure reply (0 - disabled), e.g. 4KB").Default("0").Bytes()
+	envPolicy     = app.Flag("env", "Environment of script: inherit from parent, whitelist (see --env-allow) or clean").Default("inherit").Enum("inherit", "whitelist", "clean")
+	envAllow      = app.Flag("env-allow", "Name of parent environment variable passed in whitelist mode").Strings()
+	input         = app.Flag("input", "Script stdin: message body or whole message as JSON").Default("body").Enum("body", "json")
+	output        = app.Flag("output", "Script stdout: reply body, CGI-style headers and body or message as JSON").Default("body").Enum("body", "cgi", "json")
+	retry         = common.KingpinRetry(app)
 	command       = app.Arg("command", "Command that will be run on input").Required().Strings()
 )
 
-func receiveMessages(channel *amqp.Channel) error {
+func receiveMessages(ctx context.Context, conn *amqp.Connection, channel *amqp.Channel) error {
 	log.Println("Start receiveing messages")
-	stream, err := channel.Consume(realQueue, *name, false, *exclusive, false, false, nil)
+	limit := *prefetch
+	if limit == 0 {
+		limit = *workers
+	}
+	err := channel.Qos(limit, 0, false)
 	if err != nil {
 		return err
 	}
-	for msg := range stream {
-		log.Println("Got", msg.MessageId, "from", msg.AppId)
-		err = executeScript(msg, channel)
+	stream, err := common.ConsumeContext(ctx, channel, realQueue, *name, false, *exclusive)
+	if err != nil {
+		return err
+	}
+	drain, cancel := common.DrainContext(ctx, *drainTimeout)
+	defer cancel()
 
-		if err != nil {
-			if _, ok := err.(*exec.ExitError); ok {
-				switch *errorStrategy {
-				case "drop":
-					// continue
-					log.Println("Drop failed command")
-					err = nil
-				case "stop":
-					log.Println("Stop after failed command")
-					*once = false
-					return err
-				case "restart":
-					log.Println("Restart after failed command")
-					return err
-				case "reply":
-					log.Println("Failed result reply to sender (if possible)")
-					if msg.ReplyTo != "" {
-						err = channel.Publish("", msg.ReplyTo, false, false, amqp.Publishing{
-							MessageId:     uuid.NewV4().String(),
-							Timestamp:     time.Now(),
-							CorrelationId: msg.CorrelationId,
-							Headers:       amqp.Table{"error": err.Error()},
-							Body:          []byte(err.Error()),
-						})
-					} else {
-						err = nil
-					}
-				default:
-					panic("Unknown strategy " + *errorStrategy)
+	// without ordering all workers share one queue, otherwise message goes to worker by hash of key
+	tasks := make([]chan amqp.Delivery, *workers)
+	for i := range tasks {
+		if *orderBy == "" && i > 0 {
+			tasks[i] = tasks[0]
+		} else {
+			tasks[i] = make(chan amqp.Delivery)
+		}
+	}
+	failures := make(chan error, *workers)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func(tasks <-chan amqp.Delivery) {
+			defer wg.Done()
+			for msg := range tasks {
+				err := processMessage(drain, msg, conn, channel)
+				if err != nil {
+					failures <- err
+					return
 				}
-			} else {
+			}
+		}(tasks[i])
+	}
+
+	var failure error
+	consumed := false
+LOOP:
+	for {
+		select {
+		case msg, ok := <-stream:
+			if !ok {
+				consumed = true
+				break LOOP
+			}
+			select {
+			case tasks[worker(msg)] <- msg:
+			case failure = <-failures:
+				common.CountNacked(realQueue)
+				msg.Nack(false, true)
+				break LOOP
+			}
+			if *single {
+				break LOOP
+			}
+		case failure = <-failures:
+			break LOOP
+		}
+	}
+	if *orderBy == "" {
+		close(tasks[0])
+	} else {
+		for _, t := range tasks {
+			close(t)
+		}
+	}
+	wg.Wait()
+	if failure == nil {
+		select {
+		case failure = <-failures:
+		default:
+		}
+	}
+	if failure == nil && consumed && ctx.Err() == nil {
+		failure = io.EOF
+	}
+	return failure
+}
+
+// worker index for message: messages with same order key always go to the same worker
+func worker(msg amqp.Delivery) int {
+	var key string
+	switch {
+	case *orderBy == "":
+		return 0
+	case *orderBy == "routing-key":
+		key = msg.RoutingKey
+	case *orderBy == "correlation-id":
+		key = msg.CorrelationId
+	case strings.HasPrefix(*orderBy, "header:"):
+		if value, ok := msg.Headers[strings.TrimPrefix(*orderBy, "header:")]; ok {
+			key = fmt.Sprint(value)
+		}
+	default:
+		panic("Unknown order key " + *orderBy)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(*workers))
+}
+
+// processMessage executes script and acknowledges message. Returned error stops consuming
+func processMessage(ctx context.Context, msg amqp.Delivery, conn *amqp.Connection, channel *amqp.Channel) error {
+	log.Println("Got", msg.MessageId, "from", msg.AppId)
+	err := executeScript(ctx, msg, channel)
+	if err != nil && ctx.Err() != nil {
+		log.Println("Script killed due to shutdown - message returned to queue")
+		common.CountNacked(realQueue)
+		return msg.Nack(false, true)
+	}
+	if err != nil {
+		if failed, ok := err.(*scriptError); ok {
+			switch *errorStrategy {
+			case "drop":
+				// continue
+				log.Println("Drop failed command")
+				err = nil
+			case "stop":
+				log.Println("Stop after failed command")
+				*once = false
 				return err
+			case "restart":
+				log.Println("Restart after failed command")
+				return err
+			case "retry":
+				log.Println("Retry failed command")
+				return retry.Fail(conn, realQueue, msg, err)
+			case "reply":
+				log.Println("Failed result reply to sender (if possible)")
+				if msg.ReplyTo != "" {
+					reply := common.ErrorReply(msg, &common.RPCError{Message: failed.err.Error(), Kind: failed.kind})
+					if len(failed.stderr) > 0 {
+						reply.Headers["stderr"] = string(failed.stderr)
+					}
+					err = channel.Publish("", msg.ReplyTo, false, false, reply)
+				} else {
+					err = nil
+				}
+			default:
+				panic("Unknown strategy " + *errorStrategy)
 			}
 		}
 		if err != nil {
-			break
-		}
-		err = msg.Ack(false)
-		if *single {
 			return err
 		}
-
 	}
+	err = msg.Ack(false)
 	if err == nil {
-		err = io.EOF
+		common.CountAcked(realQueue)
 	}
 	return err
 }
 
-func executeScript(msg amqp.Delivery, channel *amqp.Channel) error {
+func executeScript(ctx context.Context, msg amqp.Delivery, channel *amqp.Channel) error {
 	cmd := exec.Command((*command)[0], (*command)[1:]...)
 	log.Println(*command)
+	cmd.Env = baseEnv()
 	for header, value := range msg.Headers {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("AMQP_%s=%v", strings.ToUpper(header), value))
+		cmd.Env = append(cmd.Env, "AMQP_"+envName(header)+"="+common.HeaderString(value))
 	}
 	cmd.Env = append(cmd.Env, "CONTENT_TYPE="+msg.ContentType)
 	cmd.Env = append(cmd.Env, "CONTENT_ENCODING="+msg.ContentEncoding)
@@ -168,33 +300,102 @@ func executeScript(msg amqp.Delivery, channel *amqp.Channel) error {
 	cmd.Env = append(cmd.Env, "TYPE="+msg.Type)
 	cmd.Env = append(cmd.Env, "EXCHANGE="+msg.Exchange)
 	cmd.Env = append(cmd.Env, "ROUTING_KEY="+msg.RoutingKey)
+	cmd.Env = append(cmd.Env, "APP_ID="+msg.AppId)
+	cmd.Env = append(cmd.Env, "USER_ID="+msg.UserId)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("REDELIVERED=%v", msg.Redelivered))
 
 	cmd.Env = append(cmd.Env, fmt.Sprintf("DELIVERY_MODE=%v", msg.DeliveryMode))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("PRIORITY=%v", msg.Priority))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("TIMESTAMP=%v", msg.Timestamp.Format(time.RFC3339Nano)))
 
-	cmd.Stdin = bytes.NewBuffer(msg.Body)
-	out := &bytes.Buffer{}
+	if *input == "json" {
+		envelope, err := json.Marshal(common.FromDelivery(msg))
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = bytes.NewBuffer(envelope)
+	} else {
+		cmd.Stdin = bytes.NewBuffer(msg.Body)
+	}
+	out := &limitedBuffer{limit: int(*maxOutput)}
 	if msg.ReplyTo != "" {
 		cmd.Stdout = out
 	}
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	stderr := &truncatedBuffer{limit: int(*stderrCapture)}
+	if *stderrCapture > 0 {
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	} else {
+		cmd.Stderr = os.Stderr
+	}
+	execCtx := ctx
+	if *execTimeout > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, *execTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	err := runProcess(execCtx, cmd)
+	common.ObserveScript(exitCode(ctx, execCtx, cmd, err), time.Since(started))
 	if err != nil {
 		log.Println("Execution failed")
-		return err
+		if ctx.Err() != nil {
+			return err
+		}
+		failure := &scriptError{kind: failExit, err: err, stderr: stderr.Bytes()}
+		if execCtx.Err() == context.DeadlineExceeded {
+			failure.kind = failTimeout
+			failure.err = errors.Errorf("Script timeout after %v", *execTimeout)
+		} else if out.exceeded {
+			failure.kind = failOutputLimit
+			failure.err = OutputLimitExceeded
+		} else if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+		return failure
 	}
 	if msg.ReplyTo != "" {
-		return channel.Publish("", msg.ReplyTo, false, false, amqp.Publishing{
-			MessageId:     uuid.NewV4().String(),
-			Timestamp:     time.Now(),
-			CorrelationId: msg.CorrelationId,
-			Body:          out.Bytes(),
-		})
+		res, err := buildReply(msg, out.Bytes())
+		if err != nil {
+			log.Println("Invalid script output:", err)
+			return &scriptError{kind: failInvalidOutput, err: err, stderr: stderr.Bytes()}
+		}
+		return channel.Publish(res.Exchange, res.RoutingKey, false, false, res.Publishing)
 	}
 	return nil
 }
 
+// baseEnv of script: inherited from parent, only whitelisted variables or empty
+func baseEnv() []string {
+	var env []string
+	switch *envPolicy {
+	case "inherit":
+		env = os.Environ()
+	case "whitelist":
+		for _, name := range *envAllow {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	case "clean":
+	default:
+		panic("Unknown env policy " + *envPolicy)
+	}
+	return env
+}
+
+// envName converts header name to environment variable name: upper case, non-alphanumeric replaced by underscore
+func envName(header string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, header)
+}
+
 func defApp() string {
 	host, _ := os.Hostname()
 	return fmt.Sprintf("%v@%v", host, os.Getpid())
@@ -203,20 +404,35 @@ func defApp() string {
 func main() {
 	app.DefaultEnvars()
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	if *workers < 1 {
+		kingpin.Fatalf("at least one worker required")
+	}
+	if *orderBy != "" && *orderBy != "routing-key" && *orderBy != "correlation-id" && !strings.HasPrefix(*orderBy, "header:") {
+		kingpin.Fatalf("unknown order key %v", *orderBy)
+	}
+	if *errorStrategy == "retry" && !retry.Enabled() {
+		kingpin.Fatalf("--fail retry requires --retry-attempts")
+	}
 
 	if *quiet {
 		log.SetOutput(ioutil.Discard)
 	} else {
 		log.SetOutput(os.Stderr)
 	}
+	common.ServeMetrics(*metricsListen)
+	ctx := common.SignalContext()
 	var err error
 	for {
-		err = run()
-		if *once || err == nil {
+		err = run(ctx)
+		if *once || err == nil || ctx.Err() != nil {
 			break
 		}
 		log.Println("Error", err, "- waiting", *reconnectInterval)
-		time.Sleep(*reconnectInterval)
+		select {
+		case <-time.After(*reconnectInterval):
+			common.CountReconnect()
+		case <-ctx.Done():
+		}
 	}
 	if err != nil {
 		os.Exit(1)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	failExit          = "exit"
+	failTimeout       = "timeout"
+	failOutputLimit   = "output-limit"
+	failInvalidOutput = "invalid-output"
+)
+
+var OutputLimitExceeded = errors.New("Script output limit exceeded")
+
+// scriptError describes failed script: kind goes to error-kind header of reply
+type scriptError struct {
+	kind   string
+	err    error
+	stderr []byte
+}
+
+func (se *scriptError) Error() string {
+	return se.err.Error()
+}
+
+// runProcess starts command in own process group and waits for it. Whole group is killed when context done
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return ctx.Err()
+	}
+}
+
+// exitCode of finished script for metrics: code itself or reason if script did not exit by itself
+func exitCode(ctx, execCtx context.Context, cmd *exec.Cmd, err error) string {
+	switch {
+	case ctx.Err() != nil:
+		return "killed"
+	case execCtx.Err() == context.DeadlineExceeded:
+		return failTimeout
+	case cmd.ProcessState == nil:
+		return "not-started"
+	case err != nil && !cmd.ProcessState.Exited():
+		return "signal"
+	}
+	return strconv.Itoa(cmd.ProcessState.ExitCode())
+}
+
+// limitedBuffer fails write after limit (0 - unlimited), so script gets broken pipe on too large output. Buffer is not
+// embedded: promoted ReadFrom would bypass the limit in io.Copy
+type limitedBuffer struct {
+	buffer   bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (lb *limitedBuffer) Write(data []byte) (int, error) {
+	if lb.limit > 0 && lb.buffer.Len()+len(data) > lb.limit {
+		lb.exceeded = true
+		return 0, OutputLimitExceeded
+	}
+	return lb.buffer.Write(data)
+}
+
+func (lb *limitedBuffer) Bytes() []byte {
+	return lb.buffer.Bytes()
+}
+
+// truncatedBuffer keeps only first limit bytes and silently discards rest
+type truncatedBuffer struct {
+	buffer bytes.Buffer
+	limit  int
+}
+
+func (tb *truncatedBuffer) Write(data []byte) (int, error) {
+	if free := tb.limit - tb.buffer.Len(); free > 0 {
+		if len(data) > free {
+			tb.buffer.Write(data[:free])
+		} else {
+			tb.buffer.Write(data)
+		}
+	}
+	return len(data), nil
+}
+
+func (tb *truncatedBuffer) Bytes() []byte {
+	return tb.buffer.Bytes()
+}
@@ -0,0 +1,14 @@
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills only script process: process groups are not supported
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reddec/amqp-utils/common"
+	"github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+)
+
+const headerPrefix = "X-Amqp-Header-"
+
+// reply message built from script output. By default it goes to ReplyTo queue through default exchange
+type reply struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+}
+
+// buildReply parses script output according to --output mode:
+//
+// body - whole output is reply body;
+//
+// cgi - CGI-style headers (Content-Type, Content-Encoding, X-AMQP-Type, X-AMQP-Priority, X-AMQP-Expiration,
+// X-AMQP-Exchange, X-AMQP-Routing-Key and X-AMQP-Header-<name> for custom headers) then blank line and body;
+//
+// json - output is a message in JSON (see common.Message).
+func buildReply(msg amqp.Delivery, out []byte) (*reply, error) {
+	res := &reply{RoutingKey: msg.ReplyTo}
+	switch *output {
+	case "body":
+		res.Publishing.Body = out
+	case "cgi":
+		reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(out)))
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(reader.R)
+		if err != nil {
+			return nil, err
+		}
+		res.Publishing.Body = body
+		res.Publishing.ContentType = header.Get("Content-Type")
+		res.Publishing.ContentEncoding = header.Get("Content-Encoding")
+		res.Publishing.Type = header.Get("X-Amqp-Type")
+		res.Publishing.Expiration = header.Get("X-Amqp-Expiration")
+		if priority := header.Get("X-Amqp-Priority"); priority != "" {
+			value, err := strconv.ParseUint(priority, 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			res.Publishing.Priority = uint8(value)
+		}
+		if exchange := header.Get("X-Amqp-Exchange"); exchange != "" {
+			res.Exchange = exchange
+		}
+		if key := header.Get("X-Amqp-Routing-Key"); key != "" {
+			res.RoutingKey = key
+		}
+		for name, values := range header {
+			if strings.HasPrefix(name, headerPrefix) && len(values) > 0 {
+				if res.Publishing.Headers == nil {
+					res.Publishing.Headers = make(amqp.Table)
+				}
+				res.Publishing.Headers[strings.ToLower(strings.TrimPrefix(name, headerPrefix))] = values[0]
+			}
+		}
+	case "json":
+		var envelope common.Message
+		err := json.Unmarshal(out, &envelope)
+		if err != nil {
+			return nil, err
+		}
+		res.Publishing = envelope.Publishing()
+		if envelope.Exchange != "" {
+			res.Exchange = envelope.Exchange
+		}
+		if envelope.RoutingKey != "" {
+			res.RoutingKey = envelope.RoutingKey
+		}
+	default:
+		panic("Unknown output format " + *output)
+	}
+	if res.Publishing.MessageId == "" {
+		res.Publishing.MessageId = uuid.NewV4().String()
+	}
+	if res.Publishing.Timestamp.IsZero() {
+		res.Publishing.Timestamp = time.Now()
+	}
+	if res.Publishing.CorrelationId == "" {
+		res.Publishing.CorrelationId = msg.CorrelationId
+	}
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func request() amqp.Delivery {
+	return amqp.Delivery{ReplyTo: "amq.rabbitmq.reply-to.abc", CorrelationId: "corr-1"}
+}
+
+func TestBuildReplyBody(t *testing.T) {
+	*output = "body"
+	res, err := buildReply(request(), []byte("Content-Type: text/plain\n\nhello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Publishing.Body) != "Content-Type: text/plain\n\nhello" {
+		t.Errorf("body: got %q", res.Publishing.Body)
+	}
+	if res.Exchange != "" || res.RoutingKey != "amq.rabbitmq.reply-to.abc" {
+		t.Errorf("destination: got %q %q", res.Exchange, res.RoutingKey)
+	}
+	if res.Publishing.CorrelationId != "corr-1" || res.Publishing.MessageId == "" || res.Publishing.Timestamp.IsZero() {
+		t.Errorf("properties: got %+v", res.Publishing)
+	}
+}
+
+func TestBuildReplyCGI(t *testing.T) {
+	*output = "cgi"
+	out := "Content-Type: application/json\r\n" +
+		"X-AMQP-Type: result\n" +
+		"X-AMQP-Priority: 5\n" +
+		"X-AMQP-Expiration: 60000\n" +
+		"X-AMQP-Exchange: results\n" +
+		"X-AMQP-Routing-Key: jobs.done\n" +
+		"X-AMQP-Header-Job-Id: 42\n" +
+		"\n" +
+		"{\"ok\":true}\n\nsecond paragraph"
+	res, err := buildReply(request(), []byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := res.Publishing
+	if string(pub.Body) != "{\"ok\":true}\n\nsecond paragraph" {
+		t.Errorf("body: got %q", pub.Body)
+	}
+	if pub.ContentType != "application/json" || pub.Type != "result" || pub.Priority != 5 || pub.Expiration != "60000" {
+		t.Errorf("properties: got %+v", pub)
+	}
+	if res.Exchange != "results" || res.RoutingKey != "jobs.done" {
+		t.Errorf("destination: got %q %q", res.Exchange, res.RoutingKey)
+	}
+	if pub.Headers["job-id"] != "42" {
+		t.Errorf("headers: got %v", pub.Headers)
+	}
+	if pub.CorrelationId != "corr-1" {
+		t.Errorf("correlation id: got %q", pub.CorrelationId)
+	}
+
+	for _, invalid := range []string{"X-AMQP-Priority: high\n\nbody", "no headers"} {
+		if _, err := buildReply(request(), []byte(invalid)); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestBuildReplyJSON(t *testing.T) {
+	*output = "json"
+	out := `{"body":"ok","routing_key":"jobs.done","correlation_id":"own","message_id":"id-1","headers":{"a":"b"}}`
+	res, err := buildReply(request(), []byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := res.Publishing
+	if string(pub.Body) != "ok" || pub.CorrelationId != "own" || pub.MessageId != "id-1" || pub.Headers["a"] != "b" {
+		t.Errorf("properties: got %+v", pub)
+	}
+	if res.Exchange != "" || res.RoutingKey != "jobs.done" {
+		t.Errorf("destination: got %q %q", res.Exchange, res.RoutingKey)
+	}
+	if _, err := buildReply(request(), []byte("not json")); err == nil {
+		t.Error("invalid json accepted")
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"html/template"
 	"io"
@@ -23,11 +25,15 @@ var consumer = flag.String("name", "", "Consumer name")
 var retry = flag.Duration("retry", 5*time.Second, "Retry interval for push to HTTP server")
 var timeout = flag.Duration("timeout", 20*time.Second, "HTTP POST request timeout")
 var parallel = flag.Int("parallel", 1, "Parallel factors for sending")
+var topology = flag.String("topology", "", "YAML file with topology (exchanges, queues, binds) to declare")
 
 var convert = flag.String("template", "", "Template (Go) that prepares message body before send")
 var headers = common.FlagMapFlags("header", common.MapFlags{"Content-Type": "application/json"}, "HTTP Header (repeated) in k=v format")
+var retryPolicy = common.FlagRetry()
+var drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "Time to finish in-flight HTTP requests on shutdown")
+var metricsListen = flag.String("metrics-listen", "", "Address to expose Prometheus metrics on /metrics (ex: :9100)")
 
-func sender(consumer <-chan amqp.Delivery, retry time.Duration, templ *template.Template) {
+func sender(ctx, drain context.Context, connection *amqp.Connection, consumer <-chan amqp.Delivery, retry time.Duration, templ *template.Template) {
 	client := &http.Client{Timeout: *timeout}
 	urlIdx := 0
 	for msg := range consumer {
@@ -35,21 +41,7 @@ func sender(consumer <-chan amqp.Delivery, retry time.Duration, templ *template.
 		var data []byte
 		var err error
 
-		toSend := common.Message{}
-		toSend.Body = string(msg.Body)
-		toSend.Headers = msg.Headers
-		toSend.ContentType = msg.ContentType
-		toSend.ContentEncoding = msg.ContentEncoding
-		toSend.DeliveryMode = msg.DeliveryMode
-		toSend.Priority = msg.Priority
-		toSend.CorrelationId = msg.CorrelationId
-		toSend.ReplyTo = msg.ReplyTo
-		toSend.Expiration = msg.Expiration
-		toSend.MessageId = msg.MessageId
-		toSend.Timestamp = msg.Timestamp
-		toSend.Type = msg.Type
-		toSend.Exchange = msg.Exchange
-		toSend.RoutingKey = msg.RoutingKey
+		toSend := common.FromDelivery(msg)
 
 		if templ == nil {
 			data, err = json.Marshal(toSend)
@@ -61,39 +53,66 @@ func sender(consumer <-chan amqp.Delivery, retry time.Duration, templ *template.
 		if err != nil {
 			log.Fatal(err)
 		}
+		attempts := 0
 		for {
-			req, err := http.NewRequest(http.MethodPost, (*target)[urlIdx], bytes.NewBuffer(data))
-			if err != nil {
-				log.Fatal("Create request:", err)
+			err = push(drain, client, (*target)[urlIdx], data)
+			if err == nil {
+				log.Println("Sent")
+				break
 			}
-			for k, v := range *headers {
-				req.Header.Set(k, v)
+			log.Println(err)
+			urlIdx = (urlIdx + 1) % len(*target)
+			attempts++
+			if (retryPolicy.Enabled() && attempts >= len(*target)) || ctx.Err() != nil {
+				break
 			}
-			response, err := client.Do(req)
-			if err != nil {
-				log.Println(err)
-				time.Sleep(retry)
-				urlIdx = (urlIdx + 1) % len(*target)
-				continue
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
 			}
-			io.Copy(os.Stdout, response.Body)
-			response.Body.Close()
-			if response.StatusCode/100 != 2 {
-				log.Println("Unsuccess status code:", response.StatusCode, response.Status)
-				time.Sleep(retry)
-				urlIdx = (urlIdx + 1) % len(*target)
-				continue
+		}
+		if err != nil && ctx.Err() != nil {
+			log.Println("Message", msg.MessageId, "returned to queue due to shutdown")
+			common.CountNacked(*queue)
+			err = msg.Nack(false, true)
+		} else if err != nil {
+			err = retryPolicy.Fail(connection, *queue, msg, err)
+		} else {
+			err = msg.Ack(false)
+			if err == nil {
+				common.CountAcked(*queue)
 			}
-			log.Println("Sent")
-			break
 		}
-		err = msg.Ack(false)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
+func push(ctx context.Context, client *http.Client, url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		log.Fatal("Create request:", err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range *headers {
+		req.Header.Set(k, v)
+	}
+	started := time.Now()
+	response, err := client.Do(req)
+	if err != nil {
+		common.ObserveHTTPPush(0, time.Since(started))
+		return err
+	}
+	io.Copy(os.Stdout, response.Body)
+	response.Body.Close()
+	common.ObserveHTTPPush(response.StatusCode, time.Since(started))
+	if response.StatusCode/100 != 2 {
+		return errors.New("Unsuccess status code: " + response.Status)
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	log.SetOutput(os.Stderr)
@@ -109,6 +128,7 @@ func main() {
 		}
 		templ = t
 	}
+	common.ServeMetrics(*metricsListen)
 
 	connection, err := amqp.Dial(*server)
 	if err != nil {
@@ -120,7 +140,18 @@ func main() {
 		log.Fatal(err)
 	}
 	defer channel.Close()
-	consumer, err := channel.Consume(*queue, *consumer, false, false, true, false, nil)
+	if *topology != "" {
+		var infrastructure common.Infrastructure
+		common.MustRead(*topology, &infrastructure)
+		err = infrastructure.Create(channel)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx := common.SignalContext()
+	drain, cancel := common.DrainContext(ctx, *drainTimeout)
+	defer cancel()
+	consumer, err := common.ConsumeContext(ctx, channel, *queue, *consumer, false, false)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -130,7 +161,7 @@ func main() {
 	for i := 0; i < *parallel; i++ {
 		go func() {
 			defer wg.Done()
-			sender(consumer, *retry, templ)
+			sender(ctx, drain, connection, consumer, *retry, templ)
 		}()
 	}
 	log.Println("Started")
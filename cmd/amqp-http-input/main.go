@@ -18,7 +18,9 @@ var key = flag.String("key", "", "Routing key to publish. If not set - queue fro
 var exchange = flag.String("exchange", "", "Exchange name. If not set - exchange from message will be set")
 var from = flag.String("from", ":9002", "Bind http listener")
 var name = flag.String("name", "", "Producer name (app name)")
+var topology = flag.String("topology", "", "YAML file with topology (exchanges, queues, binds) to declare")
 var auths = common.FlagAuths("auth", common.AuthFlags{}, "Authentication pair (repeated) - user:password")
+var metricsListen = flag.String("metrics-listen", "", "Address to expose Prometheus metrics on /metrics (ex: :9100)")
 
 func main() {
 	flag.Parse()
@@ -33,6 +35,14 @@ func main() {
 		log.Fatal(err)
 	}
 	defer channel.Close()
+	if *topology != "" {
+		var infrastructure common.Infrastructure
+		common.MustRead(*topology, &infrastructure)
+		err = infrastructure.Create(channel)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	if len(*auths) > 0 {
 		log.Println("HTTP Basic Auth activated")
 	} else {
@@ -89,9 +99,15 @@ func main() {
 			log.Fatal(err)
 			return
 		}
+		if *exchange != "" {
+			common.CountPublished(*exchange)
+		} else {
+			common.CountPublished(common.OtherExchange)
+		}
 		log.Println("Message pushed", targetExchange, "::", targetKey)
 		resp.WriteHeader(http.StatusNoContent)
 	})
+	common.ServeMetrics(*metricsListen)
 	log.Println("Ready")
 	log.Fatal(http.ListenAndServe(*from, nil))
 }
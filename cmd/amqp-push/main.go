@@ -1,7 +1,9 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,8 +12,10 @@ import (
 
 	"github.com/satori/go.uuid"
 	"github.com/streadway/amqp"
+	"github.com/reddec/amqp-utils/common"
 	"github.com/alecthomas/kingpin"
 	"fmt"
+	"github.com/pkg/errors"
 )
 
 var app = kingpin.New("amqp-push", "Push data to AMQP broker")
@@ -24,14 +28,25 @@ var (
 	passive           = app.Flag("passive", "Do not try to create infrastructure").Short('p').Bool()
 	once              = app.Flag("once", "Do not reconnect to AMQP").Bool()
 	reconnectInterval = app.Flag("interval", "Reconnect interval").Short('w').Default("3s").Duration()
+	topology          = app.Flag("topology", "YAML file with topology (exchanges, queues, binds) to declare").ExistingFile()
 	quiet             = app.Flag("quiet", "Disable verbose logging").Bool()
 	key               = app.Arg("routing-key", "Routing key to publish").String()
 )
 
 func createInfrastructure(channel *amqp.Channel) error {
-	log.Println("Checking exchange", *exchange, "type", *exchangeType)
-	err := channel.ExchangeDeclare(*exchange, *exchangeType, true, false, false, false, nil)
-	return err
+	if *topology != "" {
+		var infrastructure common.Infrastructure
+		err := common.Read(*topology, &infrastructure)
+		if err != nil {
+			return err
+		}
+		err = infrastructure.Create(channel)
+		if err != nil {
+			return err
+		}
+	}
+	ex := common.Exchange{Name: *exchange, Type: *exchangeType, Durable: true}
+	return ex.Create(channel)
 }
 
 func run() error {
@@ -65,71 +80,273 @@ var (
 	name            = app.Flag("app", "Producer name (app name)").Default(defApp()).Short('a').String()
 	single          = app.Flag("single", "Use all STDIN as one message").Short('1').Bool()
 	headers         = app.Flag("header", "Additional headers").Short('h').StringMap()
-	sep             = app.Flag("sep", "Message separator").Default("\n").String()
+	sep             = app.Flag("sep", "Message separator (can be multi-byte, not included into message)").Default("\n").String()
+	framing         = app.Flag("framing", "Input framing: delimiter (--sep), varint or length (4-byte big-endian) prefixed, base64 per line").Default(common.FramingDelimiter).Enum(common.Framings...)
 	zero            = app.Flag("0", "Zero separator").Short('0').Bool()
 	correlationID   = app.Flag("correlation-id", "Correlation message ID").String()
 	contentType     = app.Flag("content-type", "Content type of message body").String()
 	contentEncoding = app.Flag("content-encoding", "Content encoding of body").String()
 	replyTo         = app.Flag("reply-to", "Routing key for reply").String()
+	confirm         = app.Flag("confirm", "Wait for publisher confirms, print message ID only after confirmation and resend unconfirmed messages after reconnect").Short('c').Bool()
+	maxInflight     = app.Flag("max-inflight", "Maximum number of unconfirmed messages in confirm mode").Default("100").Int()
+	rate            = app.Flag("rate", "Publish rate limit: N/s, N/m, N/100ms (empty - unlimited)").String()
+	burst           = app.Flag("burst", "Number of messages sent without rate limit delay").Default("1").Int()
+	statsInterval   = app.Flag("stats", "Print throughput stats to stderr with interval (0 - only summary in log)").Duration()
+	mandatory       = app.Flag("mandatory", "Unroutable messages are returned by broker and treated as failed (implies --confirm)").Short('m').Bool()
+	input           = app.Flag("input", "Input format: raw (line is body) or json (line is common.Message as printed by amqp-cat --format ndjson)").Default("raw").Enum("raw", "json")
+	skipInvalid     = app.Flag("skip-invalid", "Skip invalid messages of json input (counted as failed) instead of stop").Bool()
+	keepUser        = app.Flag("keep-user-id", "Keep user ID of json input (broker rejects message if it differs from connection user)").Bool()
 )
 
-func sendMessage(channel *amqp.Channel, data []byte) error {
-	mheaders := map[string]interface{}{}
+// message to publish with destination
+type message struct {
+	exchange   string
+	routingKey string
+	publishing amqp.Publishing
+	sentAt     time.Time
+}
+
+// parseMessage makes message from input. In json mode input is common.Message or record of amqp-dump archive (typed
+// headers, base64 body): its exchange, routing key and properties replace flags, empty message ID and timestamp are
+// generated
+func parseMessage(data []byte) (*message, error) {
+	res := &message{exchange: *exchange, routingKey: *key}
+	if *input == "json" {
+		var record common.ArchiveRecord
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return nil, err
+		}
+		res.publishing, err = record.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if *keepUser {
+			res.publishing.UserId = record.UserId
+		}
+		if record.Exchange != "" {
+			res.exchange = record.Exchange
+		}
+		if record.RoutingKey != "" {
+			res.routingKey = record.RoutingKey
+		}
+	} else {
+		res.publishing = amqp.Publishing{
+			Body:            data,
+			CorrelationId:   *correlationID,
+			ContentType:     *contentType,
+			ContentEncoding: *contentEncoding,
+			ReplyTo:         *replyTo,
+		}
+	}
+	msg := &res.publishing
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
 	for k, v := range *headers {
-		mheaders[k] = v
-	}
-	msg := amqp.Publishing{
-		Body:            data,
-		Headers:         mheaders,
-		Timestamp:       time.Now(),
-		MessageId:       uuid.NewV4().String(),
-		AppId:           *name,
-		CorrelationId:   *correlationID,
-		ContentType:     *contentType,
-		ContentEncoding: *contentEncoding,
-		ReplyTo:         *replyTo,
-	}
-	log.Println("Sending", msg.MessageId)
-	err := channel.Publish(*exchange, *key, false, false, msg)
+		if _, ok := msg.Headers[k]; !ok {
+			msg.Headers[k] = v
+		}
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.NewV4().String()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	if msg.AppId == "" {
+		msg.AppId = *name
+	}
+	return res, nil
+}
+
+var limiter common.RateLimit
+var counters = newStats()
+
+func sendMessage(channel *amqp.Channel, msg *message) error {
+	limiter.Wait(context.Background())
+	log.Println("Sending", msg.publishing.MessageId)
+	err := channel.Publish(msg.exchange, msg.routingKey, *mandatory, false, msg.publishing)
 	if err != nil {
 		return err
 	}
-	println(msg.MessageId)
-	log.Println("Sent message", msg.MessageId)
+	if *confirm {
+		msg.sentAt = time.Now()
+	}
 	return nil
 }
 
-var lastMessage []byte
+var InvalidMessage = errors.New("invalid message")
 
-func consumeAndSend(channel *amqp.Channel) error {
-	if *single {
-		log.Println("Waiting for EOF")
-		data, err := ioutil.ReadAll(os.Stdin)
+var frames *common.FrameReader
+var eof bool
+
+// number of last read frame (from 1)
+var frame = 0
+
+// readMessage reads next message from stdin. Returns nil at the end of input. Invalid message stops reading
+// (InvalidMessage error with frame number) or is skipped with --skip-invalid
+func readMessage() (*message, error) {
+	for !eof {
+		var data []byte
+		var err error
+		if *single {
+			log.Println("Waiting for EOF")
+			eof = true
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			log.Println("Reading message")
+			data, err = frames.Next()
+			if err == io.EOF {
+				eof = true
+				return nil, nil
+			}
+		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		return sendMessage(channel, data)
+		frame++
+		if !*single && *input == "json" && len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		msg, err := parseMessage(data)
+		if err == nil {
+			return msg, nil
+		}
+		err = errors.Wrapf(InvalidMessage, "frame %v: %v", frame, err)
+		if !*skipInvalid {
+			return nil, err
+		}
+		log.Println("Skip", err)
+		failed++
+	}
+	return nil, nil
+}
+
+var lastMessage *message
+
+func consumeAndSend(channel *amqp.Channel) error {
+	if *confirm {
+		return confirmAndSend(channel)
 	}
-	reader := bufio.NewReader(os.Stdin)
 	for {
 		if lastMessage == nil {
-			log.Println("Reading message")
-			data, err := reader.ReadBytes((*sep)[0])
+			msg, err := readMessage()
 			if err != nil {
-				if err == io.EOF {
-					err = nil
-				}
 				return err
 			}
-			lastMessage = data
+			if msg == nil {
+				return notDelivered()
+			}
+			lastMessage = msg
 		}
 		err := sendMessage(channel, lastMessage)
 		if err != nil {
 			return err
 		}
+		println(lastMessage.publishing.MessageId)
+		counters.delivered(lastMessage)
+		log.Println("Sent message", lastMessage.publishing.MessageId)
 		lastMessage = nil
 	}
+}
+
+var DeliveryFailed = errors.New("some messages were invalid, nacked or returned by broker")
+
+// messages sent (or to be sent after reconnect) but not confirmed yet
+var unconfirmed []*message
+var failed = 0
+
+// invalid input stops reading, but sent messages are confirmed first
+var invalid error
+
+func notDelivered() error {
+	if failed > 0 {
+		log.Println(failed, "messages were not delivered")
+		return DeliveryFailed
+	}
+	return nil
+}
 
+// confirmAndSend keeps up to --max-inflight unconfirmed messages. Message ID is printed only after broker confirmation.
+// After reconnect all unconfirmed messages are sent again (at-least-once, consumers may get duplicates)
+func confirmAndSend(channel *amqp.Channel) error {
+	err := channel.Confirm(false)
+	if err != nil {
+		return err
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, *maxInflight))
+	returns := channel.NotifyReturn(make(chan amqp.Return, *maxInflight))
+	returned := make(map[string]string)
+	if len(unconfirmed) > 0 {
+		log.Println("Resending", len(unconfirmed), "unconfirmed messages")
+	}
+	sent := 0
+	for {
+		for {
+			if sent == len(unconfirmed) {
+				if eof || len(unconfirmed) >= *maxInflight {
+					break
+				}
+				msg, err := readMessage()
+				if errors.Cause(err) == InvalidMessage {
+					invalid = err
+					eof = true
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if msg == nil {
+					break
+				}
+				unconfirmed = append(unconfirmed, msg)
+			}
+			err = sendMessage(channel, unconfirmed[sent])
+			if err != nil {
+				return err
+			}
+			sent++
+		}
+		if len(unconfirmed) == 0 {
+			err = notDelivered()
+			if invalid != nil {
+				return invalid
+			}
+			return err
+		}
+		confirmation, ok := <-confirms
+		if !ok {
+			return errors.New("Channel closed before confirmation")
+		}
+		// broker sends basic.return before basic.ack of the same message
+	drain:
+		for {
+			select {
+			case ret := <-returns:
+				returned[ret.MessageId] = ret.ReplyText
+			default:
+				break drain
+			}
+		}
+		// confirmations come in order of publishing
+		msg := unconfirmed[0]
+		unconfirmed = unconfirmed[1:]
+		sent--
+		id := msg.publishing.MessageId
+		if reason, ok := returned[id]; ok {
+			delete(returned, id)
+			log.Println("Message", id, "returned:", reason)
+			failed++
+		} else if !confirmation.Ack {
+			log.Println("Message", id, "nacked by broker")
+			failed++
+		} else {
+			println(id)
+			counters.delivered(msg)
+			log.Println("Confirmed message", id)
+		}
+	}
 }
 
 func defApp() string {
@@ -148,16 +365,35 @@ func main() {
 	} else {
 		log.SetOutput(os.Stderr)
 	}
+	if *mandatory {
+		*confirm = true
+	}
+	if *maxInflight < 1 {
+		*maxInflight = 1
+	}
+	if *rate != "" {
+		value, err := common.ParseRate(*rate)
+		kingpin.FatalIfError(err, "")
+		limiter = common.RateLimit{Rate: value, Burst: *burst}
+	}
+	frames = common.NewFrameReader(os.Stdin, *framing, *sep)
+	if *statsInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go counters.reportEvery(*statsInterval, done)
+	}
 	var err error
 	for {
 		err = run()
-		if *once || err == nil {
+		if *once || err == nil || err == DeliveryFailed || errors.Cause(err) == InvalidMessage {
 			break
 		}
 		log.Println("Error", err, "- waiting", *reconnectInterval)
 		time.Sleep(*reconnectInterval)
 	}
+	printStats(counters.summary())
 	if err != nil {
+		log.Println("Error", err)
 		os.Exit(1)
 	} else {
 		os.Exit(0)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/reddec/amqp-utils/common"
+	"github.com/streadway/amqp"
+)
+
+func delivery() amqp.Delivery {
+	return amqp.Delivery{
+		Exchange:    "orders",
+		RoutingKey:  "orders.created",
+		MessageId:   "id-1",
+		Timestamp:   time.Unix(1500000000, 0).UTC(),
+		ContentType: "application/octet-stream",
+		Headers: amqp.Table{
+			"count":   int32(3),
+			"long":    int64(1) << 40,
+			"ratio":   2.5,
+			"tenant":  "acme",
+			"raw":     []byte{0, 0xff},
+			"nested":  amqp.Table{"flag": true},
+			"x-death": []interface{}{amqp.Table{"count": int64(1), "queue": "orders"}},
+		},
+		Body: []byte{0, 1, 0xfe, 0xff},
+	}
+}
+
+func TestParseArchiveRecord(t *testing.T) {
+	*input = "json"
+	msg := delivery()
+	data, err := json.Marshal(common.NewArchiveRecord(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := parseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.exchange != msg.Exchange || res.routingKey != msg.RoutingKey {
+		t.Errorf("destination: got %q %q", res.exchange, res.routingKey)
+	}
+	pub := res.publishing
+	if !reflect.DeepEqual(pub.Body, msg.Body) {
+		t.Errorf("body: got %v, want %v", pub.Body, msg.Body)
+	}
+	if !reflect.DeepEqual(pub.Headers, msg.Headers) {
+		t.Errorf("headers: got %#v, want %#v", pub.Headers, msg.Headers)
+	}
+	if pub.MessageId != msg.MessageId || !pub.Timestamp.Equal(msg.Timestamp) || pub.ContentType != msg.ContentType {
+		t.Errorf("properties: got %+v", pub)
+	}
+}
+
+func TestParsePlainMessage(t *testing.T) {
+	*input = "json"
+	data := `{"exchange":"orders","routing_key":"orders.created","body":"text","headers":{"tenant":"acme","count":3}}`
+	res, err := parseMessage([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.publishing.Body) != "text" || res.exchange != "orders" || res.routingKey != "orders.created" {
+		t.Errorf("unexpected message %+v", res)
+	}
+	expected := amqp.Table{"tenant": "acme", "count": int64(3)}
+	if !reflect.DeepEqual(res.publishing.Headers, expected) {
+		t.Errorf("headers: got %#v, want %#v", res.publishing.Headers, expected)
+	}
+	if res.publishing.MessageId == "" || res.publishing.Timestamp.IsZero() {
+		t.Errorf("message ID and timestamp are not generated: %+v", res.publishing)
+	}
+}
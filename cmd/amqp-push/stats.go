@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// stats of delivered messages: total and since last report
+type stats struct {
+	lock       sync.Mutex
+	started    time.Time
+	reported   time.Time
+	messages   int64
+	bytes      int64
+	periodMsgs int64
+	periodSize int64
+	latency    time.Duration
+	confirms   int64
+	maxLatency time.Duration
+}
+
+func newStats() *stats {
+	now := time.Now()
+	return &stats{started: now, reported: now}
+}
+
+// delivered counts message sent (without confirms) or confirmed by broker
+func (s *stats) delivered(msg *message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	size := int64(len(msg.publishing.Body))
+	s.messages++
+	s.bytes += size
+	s.periodMsgs++
+	s.periodSize += size
+	if !msg.sentAt.IsZero() {
+		latency := time.Since(msg.sentAt)
+		s.latency += latency
+		s.confirms++
+		if latency > s.maxLatency {
+			s.maxLatency = latency
+		}
+	}
+}
+
+// report returns stats line for period since last report
+func (s *stats) report() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(s.reported).Seconds()
+	line := fmt.Sprintf("%.1f msg/s, %.1f KiB/s, %v messages, %v bytes", float64(s.periodMsgs)/elapsed,
+		float64(s.periodSize)/1024/elapsed, s.messages, s.bytes)
+	s.reported = now
+	s.periodMsgs = 0
+	s.periodSize = 0
+	return line + s.latencyInfo()
+}
+
+// summary returns stats line for whole run
+func (s *stats) summary() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elapsed := time.Since(s.started)
+	seconds := elapsed.Seconds()
+	return fmt.Sprintf("%v messages, %v bytes in %v (%.1f msg/s, %.1f KiB/s)", s.messages, s.bytes,
+		elapsed.Round(time.Millisecond), float64(s.messages)/seconds, float64(s.bytes)/1024/seconds) + s.latencyInfo()
+}
+
+func (s *stats) latencyInfo() string {
+	if s.confirms == 0 {
+		return ""
+	}
+	avg := s.latency / time.Duration(s.confirms)
+	return fmt.Sprintf(", confirm latency avg %v max %v", avg.Round(time.Microsecond), s.maxLatency.Round(time.Microsecond))
+}
+
+// reportEvery logs stats line until done closed
+func (s *stats) reportEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			printStats(s.report())
+		case <-done:
+			return
+		}
+	}
+}
+
+// printStats writes stats to stderr if --stats enabled (even in quiet mode), otherwise to log
+func printStats(line string) {
+	if *statsInterval > 0 {
+		fmt.Fprintln(os.Stderr, "Stats:", line)
+	} else {
+		log.Println("Stats:", line)
+	}
+}
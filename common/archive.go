@@ -0,0 +1,154 @@
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// ArchiveRecord is line of queue archive (NDJSON): message with body in base64 if it is not valid UTF-8 text. Headers
+// keep AMQP types (JSON has no integer, binary or timestamp types), so restored message has the same headers
+type ArchiveRecord struct {
+	Message
+	Headers      TypedTable `json:"headers,omitempty"`
+	BodyEncoding string     `json:"body_encoding,omitempty"`
+}
+
+func NewArchiveRecord(msg amqp.Delivery) ArchiveRecord {
+	record := ArchiveRecord{Message: FromDelivery(msg), Headers: NewTypedTable(msg.Headers)}
+	record.Message.Headers = nil
+	if !utf8.Valid(msg.Body) {
+		record.Body = base64.StdEncoding.EncodeToString(msg.Body)
+		record.BodyEncoding = "base64"
+	}
+	return record
+}
+
+// Decode restores message with original body
+func (r *ArchiveRecord) Decode() (amqp.Publishing, error) {
+	msg := r.Publishing()
+	msg.Headers = r.Headers.Table()
+	switch r.BodyEncoding {
+	case "":
+	case "base64":
+		body, err := base64.StdEncoding.DecodeString(r.Body)
+		if err != nil {
+			return msg, errors.Wrap(err, "decode body")
+		}
+		msg.Body = body
+	default:
+		return msg, errors.Errorf("unknown body encoding %v", r.BodyEncoding)
+	}
+	return msg, nil
+}
+
+// ArchiveWriter writes records to file (or stdout if name is -) optionally compressed by gzip
+type ArchiveWriter struct {
+	file    *os.File
+	buffer  *bufio.Writer
+	gzip    *gzip.Writer
+	encoder *json.Encoder
+}
+
+func CreateArchive(name string, compress bool) (*ArchiveWriter, error) {
+	aw := &ArchiveWriter{file: os.Stdout}
+	if name != "-" {
+		file, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		aw.file = file
+	}
+	aw.buffer = bufio.NewWriter(aw.file)
+	var output io.Writer = aw.buffer
+	if compress {
+		aw.gzip = gzip.NewWriter(aw.buffer)
+		output = aw.gzip
+	}
+	aw.encoder = json.NewEncoder(output)
+	return aw, nil
+}
+
+func (aw *ArchiveWriter) Write(record ArchiveRecord) error {
+	return aw.encoder.Encode(record)
+}
+
+// Close flushes all data to disk. Archive is complete only if close succeeded
+func (aw *ArchiveWriter) Close() error {
+	if aw.gzip != nil {
+		if err := aw.gzip.Close(); err != nil {
+			return err
+		}
+	}
+	if err := aw.buffer.Flush(); err != nil {
+		return err
+	}
+	if aw.file == os.Stdout {
+		return nil
+	}
+	if err := aw.file.Sync(); err != nil {
+		aw.file.Close()
+		return err
+	}
+	return aw.file.Close()
+}
+
+// ArchiveReader reads records from file (or stdin if name is -). Gzip is detected automatically
+type ArchiveReader struct {
+	file    *os.File
+	decoder *json.Decoder
+}
+
+func OpenArchive(name string) (*ArchiveReader, error) {
+	ar := &ArchiveReader{file: os.Stdin}
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		ar.file = file
+	}
+	buffer := bufio.NewReader(ar.file)
+	var input io.Reader = buffer
+	magic, err := buffer.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzip, err := gzip.NewReader(buffer)
+		if err != nil {
+			ar.Close()
+			return nil, err
+		}
+		input = unzip
+	}
+	ar.decoder = json.NewDecoder(input)
+	return ar, nil
+}
+
+// Read next record. Returns io.EOF at the end of archive
+func (ar *ArchiveReader) Read() (*ArchiveRecord, error) {
+	var record ArchiveRecord
+	err := ar.decoder.Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (ar *ArchiveReader) Close() error {
+	if ar.file == os.Stdin {
+		return nil
+	}
+	return ar.file.Close()
+}
+
+// IsGzipName checks that file name has gzip extension
+func IsGzipName(name string) bool {
+	return strings.HasSuffix(name, ".gz")
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func typedHeaders() amqp.Table {
+	stamp := time.Unix(1500000000, 0).UTC()
+	return amqp.Table{
+		RetryCountHeader: int32(3),
+		"long":           int64(1) << 40,
+		"short":          int16(-7),
+		"byte":           byte(200),
+		"bool":           false,
+		"float":          float32(1.5),
+		"double":         2.25,
+		"decimal":        amqp.Decimal{Scale: 2, Value: 12345},
+		"string":         "text",
+		"empty":          "",
+		"bytes":          []byte{0, 1, 0xff},
+		"timestamp":      stamp,
+		"void":           nil,
+		"x-death": []interface{}{amqp.Table{
+			"count":        int64(2),
+			"reason":       "expired",
+			"queue":        "orders",
+			"time":         stamp,
+			"routing-keys": []interface{}{"a", "b"},
+		}},
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "dump.ndjson")
+		archive, err := CreateArchive(name, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original := amqp.Delivery{
+			Headers:     typedHeaders(),
+			Body:        []byte{0xff, 0xfe, 0},
+			MessageId:   "id",
+			Exchange:    "ex",
+			RoutingKey:  "key",
+			ContentType: "application/octet-stream",
+			Timestamp:   time.Unix(1500000000, 0).UTC(),
+		}
+		if err = archive.Write(NewArchiveRecord(original)); err != nil {
+			t.Fatal(err)
+		}
+		if err = archive.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := OpenArchive(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := reader.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = reader.Read(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+		reader.Close()
+
+		msg, err := record.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg.Headers, typedHeaders()) {
+			t.Fatalf("gzip %v: headers changed\n%#v\n%#v", compress, msg.Headers, typedHeaders())
+		}
+		if string(msg.Body) != string(original.Body) || msg.MessageId != "id" || record.Exchange != "ex" || record.RoutingKey != "key" {
+			t.Fatalf("gzip %v: message changed %#v", compress, msg)
+		}
+		if RetryCount(amqp.Delivery{Headers: msg.Headers}) != 3 {
+			t.Fatal("retry count lost")
+		}
+	}
+}
+
+func TestArchivePlainHeaders(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "plain.ndjson")
+	data := `{"headers":{"x-retry-count":3,"ratio":0.5,"name":"x","nested":{"n":1},"list":[1,"a"]},"body":"hello"}` + "\n"
+	if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenArchive(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	record, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := record.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := amqp.Table{
+		"x-retry-count": int64(3),
+		"ratio":         0.5,
+		"name":          "x",
+		"nested":        amqp.Table{"n": int64(1)},
+		"list":          []interface{}{int64(1), "a"},
+	}
+	if !reflect.DeepEqual(msg.Headers, expected) {
+		t.Fatalf("unexpected headers %#v", msg.Headers)
+	}
+	if string(msg.Body) != "hello" {
+		t.Fatalf("unexpected body %q", msg.Body)
+	}
+}
+
+func TestTypedValueUnsupported(t *testing.T) {
+	record := ArchiveRecord{Headers: TypedTable{"bad": TypedValue{Value: struct{}{}}}}
+	archive, err := CreateArchive(filepath.Join(t.TempDir(), "bad"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	err = archive.Write(record)
+	if err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("expected unsupported type error, got %v", err)
+	}
+}
+
+func TestIsGzipName(t *testing.T) {
+	if !IsGzipName("a.ndjson.gz") || IsGzipName("a.ndjson") || IsGzipName(os.DevNull) {
+		t.Fatal("unexpected gzip detection")
+	}
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Framing modes of message stream (amqp-push input, amqp-cat output):
+//
+// delimiter - messages separated by (multi-byte) separator, separator is not part of message;
+//
+// varint - each message prefixed by its length as unsigned varint (protobuf style);
+//
+// length - each message prefixed by its length as 4-byte big-endian integer;
+//
+// base64 - each message encoded as base64 on separate line (empty line is empty message).
+const (
+	FramingDelimiter = "delimiter"
+	FramingVarint    = "varint"
+	FramingLength    = "length"
+	FramingBase64    = "base64"
+)
+
+var Framings = []string{FramingDelimiter, FramingVarint, FramingLength, FramingBase64}
+
+// MaxFrameSize limits length of prefixed frame to detect corrupted stream (RabbitMQ limit of message size)
+const MaxFrameSize = 512 * 1024 * 1024
+
+type FrameReader struct {
+	mode      string
+	separator []byte
+	reader    *bufio.Reader
+}
+
+func NewFrameReader(reader io.Reader, mode string, separator string) *FrameReader {
+	return &FrameReader{mode: mode, separator: []byte(separator), reader: bufio.NewReader(reader)}
+}
+
+// Next frame. Returns io.EOF at the end of stream and io.ErrUnexpectedEOF if stream ends inside prefixed frame. Last
+// delimited frame may have no separator
+func (fr *FrameReader) Next() ([]byte, error) {
+	switch fr.mode {
+	case FramingDelimiter:
+		return fr.readDelimited(fr.separator)
+	case FramingBase64:
+		line, err := fr.readDelimited([]byte("\n"))
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(data, line)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode base64 frame")
+		}
+		return data[:n], nil
+	case FramingVarint:
+		size, err := binary.ReadUvarint(fr.reader)
+		if err != nil {
+			return nil, err
+		}
+		return fr.readFrame(size)
+	case FramingLength:
+		var prefix [4]byte
+		_, err := io.ReadFull(fr.reader, prefix[:])
+		if err != nil {
+			return nil, err
+		}
+		return fr.readFrame(uint64(binary.BigEndian.Uint32(prefix[:])))
+	}
+	return nil, errors.Errorf("unknown framing %v", fr.mode)
+}
+
+func (fr *FrameReader) readDelimited(separator []byte) ([]byte, error) {
+	if len(separator) == 0 {
+		return nil, errors.New("empty separator")
+	}
+	last := separator[len(separator)-1]
+	var frame []byte
+	for {
+		chunk, err := fr.reader.ReadBytes(last)
+		frame = append(frame, chunk...)
+		if err == io.EOF && len(frame) > 0 {
+			return frame, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasSuffix(frame, separator) {
+			return frame[:len(frame)-len(separator)], nil
+		}
+	}
+}
+
+func (fr *FrameReader) readFrame(size uint64) ([]byte, error) {
+	if size > MaxFrameSize {
+		return nil, errors.Errorf("frame size %v is too big", size)
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(fr.reader, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+type FrameWriter struct {
+	mode      string
+	separator []byte
+	writer    io.Writer
+	first     bool
+	empty     bool
+}
+
+func NewFrameWriter(writer io.Writer, mode string, separator string) *FrameWriter {
+	return &FrameWriter{mode: mode, separator: []byte(separator), writer: writer, first: true}
+}
+
+// Write frame. Delimited frames are separated (not terminated) by separator
+func (fw *FrameWriter) Write(frame []byte) error {
+	var err error
+	switch fw.mode {
+	case FramingDelimiter:
+		if !fw.first {
+			_, err = fw.writer.Write(fw.separator)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fw.writer.Write(frame)
+	case FramingBase64:
+		line := make([]byte, base64.StdEncoding.EncodedLen(len(frame))+1)
+		base64.StdEncoding.Encode(line, frame)
+		line[len(line)-1] = '\n'
+		_, err = fw.writer.Write(line)
+	case FramingVarint:
+		var prefix [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(prefix[:], uint64(len(frame)))
+		_, err = fw.writer.Write(prefix[:n])
+		if err == nil {
+			_, err = fw.writer.Write(frame)
+		}
+	case FramingLength:
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(frame)))
+		_, err = fw.writer.Write(prefix[:])
+		if err == nil {
+			_, err = fw.writer.Write(frame)
+		}
+	default:
+		return errors.Errorf("unknown framing %v", fw.mode)
+	}
+	fw.first = false
+	fw.empty = len(frame) == 0
+	return err
+}
+
+// Close ends stream: empty last delimited frame is terminated by separator, otherwise reader would not see it. Underlying
+// writer is not closed
+func (fw *FrameWriter) Close() error {
+	if fw.mode != FramingDelimiter || fw.first || !fw.empty {
+		return nil
+	}
+	_, err := fw.writer.Write(fw.separator)
+	return err
+}
@@ -0,0 +1,198 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func readFrames(t *testing.T, data []byte, mode, separator string) ([][]byte, error) {
+	t.Helper()
+	reader := NewFrameReader(bytes.NewReader(data), mode, separator)
+	var frames [][]byte
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func roundTrip(t *testing.T, mode, separator string, frames [][]byte) [][]byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := NewFrameWriter(&buf, mode, separator)
+	for _, frame := range frames {
+		if err := writer.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := readFrames(t, buf.Bytes(), mode, separator)
+	if err != nil {
+		t.Fatalf("%v: %v", mode, err)
+	}
+	return result
+}
+
+func normalize(frames [][]byte) [][]byte {
+	result := make([][]byte, len(frames))
+	for i, frame := range frames {
+		result[i] = append([]byte{}, frame...)
+	}
+	return result
+}
+
+func TestFramingRoundTrip(t *testing.T) {
+	binary := [][]byte{
+		[]byte("first"),
+		[]byte("with\nnewline"),
+		[]byte("with\r\nseparator"),
+		{0, 0x80, 0xff, '\n'},
+		[]byte("\r"),
+		{},
+		[]byte("last"),
+		{},
+	}
+	for _, mode := range []string{FramingVarint, FramingLength, FramingBase64} {
+		for _, separator := range []string{"\n", "\r\n"} {
+			got := roundTrip(t, mode, separator, binary)
+			if !reflect.DeepEqual(normalize(got), normalize(binary)) {
+				t.Errorf("%v (sep %q): got %q, want %q", mode, separator, got, binary)
+			}
+		}
+	}
+}
+
+func TestFramingDelimiter(t *testing.T) {
+	cases := []struct {
+		separator string
+		frames    [][]byte
+	}{
+		{"\n", [][]byte{[]byte("a"), []byte("b")}},
+		// partial separator is part of message
+		{"\r\n", [][]byte{[]byte("a\r"), []byte("\nb"), []byte("c\rd\ne"), []byte("\r")}},
+		{"<END>", [][]byte{[]byte("<EN"), []byte("D>"), []byte("<<END"), []byte("x")}},
+		// empty messages including the last one
+		{"\n", [][]byte{{}, []byte("a"), {}}},
+		{"\r\n", [][]byte{{}}},
+		{"\x00", [][]byte{[]byte("a\nb"), {}}},
+	}
+	for _, c := range cases {
+		got := roundTrip(t, FramingDelimiter, c.separator, c.frames)
+		if !reflect.DeepEqual(normalize(got), normalize(c.frames)) {
+			t.Errorf("sep %q: got %q, want %q", c.separator, got, c.frames)
+		}
+	}
+}
+
+func TestFramingDelimiterOutput(t *testing.T) {
+	cases := []struct {
+		frames []string
+		output string
+	}{
+		{[]string{"a"}, "a"},
+		{[]string{"a", "b"}, "a\r\nb"},
+		// separator after the last frame only if it is empty
+		{[]string{"a", ""}, "a\r\n\r\n"},
+		{[]string{""}, "\r\n"},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		writer := NewFrameWriter(&buf, FramingDelimiter, "\r\n")
+		for _, frame := range c.frames {
+			if err := writer.Write([]byte(frame)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.output {
+			t.Errorf("%q: got %q, want %q", c.frames, buf.String(), c.output)
+		}
+	}
+}
+
+func TestFramingDelimiterInput(t *testing.T) {
+	cases := []struct {
+		input     string
+		separator string
+		frames    []string
+	}{
+		// last message may have no separator
+		{"a\nb", "\n", []string{"a", "b"}},
+		{"a\r\nb\r", "\r\n", []string{"a", "b\r"}},
+		{"", "\n", nil},
+		{"\n", "\n", []string{""}},
+		// message containing separator is split
+		{"a--b--", "--", []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		got, err := readFrames(t, []byte(c.input), FramingDelimiter, c.separator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frames []string
+		for _, frame := range got {
+			frames = append(frames, string(frame))
+		}
+		if !reflect.DeepEqual(frames, c.frames) {
+			t.Errorf("%q (sep %q): got %q, want %q", c.input, c.separator, frames, c.frames)
+		}
+	}
+	_, err := readFrames(t, []byte("a"), FramingDelimiter, "")
+	if err == nil {
+		t.Error("empty separator accepted")
+	}
+}
+
+func TestFramingTruncated(t *testing.T) {
+	cases := []struct {
+		mode  string
+		input []byte
+	}{
+		{FramingLength, []byte{0, 0}},
+		{FramingLength, []byte{0, 0, 0, 5, 'a', 'b'}},
+		{FramingVarint, []byte{0x80}},
+		{FramingVarint, []byte{5, 'a', 'b'}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		NewFrameWriter(&buf, c.mode, "").Write([]byte("ok"))
+		buf.Write(c.input)
+		frames, err := readFrames(t, buf.Bytes(), c.mode, "")
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%v %v: got error %v, want %v", c.mode, c.input, err, io.ErrUnexpectedEOF)
+		}
+		if len(frames) != 1 || string(frames[0]) != "ok" {
+			t.Errorf("%v %v: got frames %q before truncated one", c.mode, c.input, frames)
+		}
+	}
+}
+
+func TestFramingInvalid(t *testing.T) {
+	_, err := readFrames(t, []byte("not base64!\n"), FramingBase64, "")
+	if err == nil {
+		t.Error("invalid base64 accepted")
+	}
+	_, err = readFrames(t, []byte{0xff, 0xff, 0xff, 0xff}, FramingLength, "")
+	if err == nil {
+		t.Error("too big frame accepted")
+	}
+	_, err = readFrames(t, []byte("a"), "unknown", "")
+	if err == nil {
+		t.Error("unknown framing accepted by reader")
+	}
+	if NewFrameWriter(&bytes.Buffer{}, "unknown", "").Write([]byte("a")) == nil {
+		t.Error("unknown framing accepted by writer")
+	}
+}
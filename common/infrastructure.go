@@ -3,70 +3,444 @@ package common
 import (
 	"github.com/streadway/amqp"
 	"context"
+	"log"
+	"time"
+	"fmt"
+	"strings"
+	"sort"
 )
 
+// Declarer is part of amqp.Channel used to declare topology
+type Declarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// Exchange declaration. Binding maps source exchange to routing keys (exchange-to-exchange binding)
 type Exchange struct {
-	Name       string `yaml:"name"`
-	Durable    bool   `yaml:"durable"`
-	Mode       string `yaml:"mode"`
-	AutoDelete bool   `yaml:"auto_delete"`
+	Name       string                 `yaml:"name"`
+	Type       string                 `yaml:"type"`
+	Durable    bool                   `yaml:"durable"`
+	AutoDelete bool                   `yaml:"auto_delete"`
+	Internal   bool                   `yaml:"internal"`
+	Passive    bool                   `yaml:"passive"`
+	Arguments  map[string]interface{} `yaml:"arguments"`
+	Binding    map[string][]string    `yaml:"binding"`
+}
+
+// UnmarshalYAML accepts deprecated keys: autodelete (auto_delete) and mode (type)
+func (e *Exchange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Exchange
+	var legacy struct {
+		AutoDelete *bool   `yaml:"autodelete"`
+		Mode       *string `yaml:"mode"`
+	}
+	if err := unmarshal((*plain)(e)); err != nil {
+		return err
+	}
+	if err := unmarshal(&legacy); err != nil {
+		return err
+	}
+	if legacy.AutoDelete != nil {
+		log.Println("Exchange", e.Name, "- key autodelete is deprecated, use auto_delete")
+		e.AutoDelete = e.AutoDelete || *legacy.AutoDelete
+	}
+	if legacy.Mode != nil {
+		log.Println("Exchange", e.Name, "- key mode is deprecated, use type")
+		if e.Type == "" {
+			e.Type = *legacy.Mode
+		}
+	}
+	return nil
 }
 
-func (exc *Exchange) Serve(channel *amqp.Channel, ctx context.Context) error {
-	return channel.ExchangeDeclare(exc.Name, exc.Mode, exc.Durable, exc.AutoDelete, false, false, nil)
+// IsDefault checks that exchange is default (nameless) exchange which can't be declared
+func (e *Exchange) IsDefault() bool {
+	return e.Name == ""
 }
 
+func (e *Exchange) Create(channel Declarer) error {
+	if e.IsDefault() {
+		return nil
+	}
+	if e.Type == "" {
+		e.Type = "topic"
+	}
+	var err error
+	if e.Passive {
+		log.Println("Checking exchange", e)
+		err = channel.ExchangeDeclarePassive(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, Table(e.Arguments))
+	} else {
+		log.Println("Creating exchange", e)
+		err = channel.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, Table(e.Arguments))
+	}
+	if err != nil {
+		return err
+	}
+	for source, keys := range e.Binding {
+		for _, key := range keys {
+			log.Println("Binding exchange", e.Name, "to exchange", source, "with routing key", key)
+			err = channel.ExchangeBind(e.Name, key, source, false, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Exchange) Serve(channel *amqp.Channel, ctx context.Context) error {
+	return e.Create(channel)
+}
+
+func (e *Exchange) String() string {
+	return e.Name + "@" + e.Type
+}
+
+// Queue declaration. Binding maps exchange to routing keys. Empty name means server-generated exclusive queue
 type Queue struct {
 	Name       string `yaml:"name"`
-	Bind       []Bind `yaml:"bind"`
-	Lazy       bool   `yaml:"lazy"`
 	Durable    bool   `yaml:"durable"`
 	AutoDelete bool   `yaml:"auto_delete"`
 	Exclusive  bool   `yaml:"exclusive"`
+	Passive    bool   `yaml:"passive"`
+
+	Lazy                 bool                   `yaml:"lazy"`                    // x-queue-mode=lazy (RabbitMQ only)
+	TTL                  time.Duration          `yaml:"ttl"`                     // x-message-ttl
+	Expires              time.Duration          `yaml:"expires"`                 // x-expires
+	MaxLength            int64                  `yaml:"max_length"`              // x-max-length
+	MaxLengthBytes       int64                  `yaml:"max_length_bytes"`        // x-max-length-bytes
+	MaxPriority          uint8                  `yaml:"max_priority"`            // x-max-priority
+	DeadLetterExchange   string                 `yaml:"dead_letter_exchange"`    // x-dead-letter-exchange
+	DeadLetterRoutingKey string                 `yaml:"dead_letter_routing_key"` // x-dead-letter-routing-key
+	Arguments            map[string]interface{} `yaml:"arguments"`               // any other arguments
+
+	Binding       map[string][]string `yaml:"binding"`
+	generatedName string
 }
 
-func (q *Queue) Serve(channel *amqp.Channel, ctx context.Context) error {
-	var args amqp.Table
+// UnmarshalYAML accepts deprecated keys: autoremove (auto_delete) and bind (list of exchange and key, merged to binding)
+func (q *Queue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Queue
+	var legacy struct {
+		AutoRemove *bool  `yaml:"autoremove"`
+		Bind       []Bind `yaml:"bind"`
+	}
+	if err := unmarshal((*plain)(q)); err != nil {
+		return err
+	}
+	if err := unmarshal(&legacy); err != nil {
+		return err
+	}
+	if legacy.AutoRemove != nil {
+		log.Println("Queue", q.Name, "- key autoremove is deprecated, use auto_delete")
+		q.AutoDelete = q.AutoDelete || *legacy.AutoRemove
+	}
+	if len(legacy.Bind) > 0 {
+		log.Println("Queue", q.Name, "- key bind is deprecated, use binding")
+		if q.Binding == nil {
+			q.Binding = make(map[string][]string)
+		}
+		for _, bnd := range legacy.Bind {
+			q.Binding[bnd.Exchange] = append(q.Binding[bnd.Exchange], bnd.RoutingKey)
+		}
+	}
+	return nil
+}
+
+func (q *Queue) RealName() string {
+	if q.generatedName == "" {
+		return q.Name
+	}
+	return q.generatedName
+}
+
+// Args of queue declaration: typed fields are merged over raw arguments
+func (q *Queue) Args() amqp.Table {
+	args := Table(q.Arguments)
+	if args == nil {
+		args = make(amqp.Table)
+	}
 	if q.Lazy {
-		args = amqp.Table{
-			"x-queue-mode": "lazy",
+		args["x-queue-mode"] = "lazy"
+	}
+	if q.TTL > 0 {
+		args["x-message-ttl"] = int64(q.TTL / time.Millisecond)
+	}
+	if q.Expires > 0 {
+		args["x-expires"] = int64(q.Expires / time.Millisecond)
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = q.MaxLengthBytes
+	}
+	if q.MaxPriority > 0 {
+		args["x-max-priority"] = int32(q.MaxPriority)
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	return args
+}
+
+func (q *Queue) Create(channel Declarer) error {
+	if q.Name == "" {
+		q.Durable = false
+		q.AutoDelete = true
+		q.Exclusive = true
+		q.Passive = false
+	}
+	var qq amqp.Queue
+	var err error
+	if q.Passive {
+		log.Println("Checking queue", q.Name)
+		qq, err = channel.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args())
+	} else {
+		log.Println("Creating queue", q.Name)
+		qq, err = channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args())
+	}
+	if err != nil {
+		return err
+	}
+	q.generatedName = qq.Name
+	log.Println("Queue name", qq.Name)
+	for exchange, keys := range q.Binding {
+		for _, key := range keys {
+			log.Println("Binding queue to exchange", exchange, "with routing key", key)
+			err := channel.QueueBind(q.RealName(), key, exchange, false, nil)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	_, err := channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, args)
-	return err
+	return nil
+}
+
+func (q *Queue) Serve(channel *amqp.Channel, ctx context.Context) error {
+	return q.Create(channel)
 }
 
+// Bind is a full form of binding: source exchange to queue or to another exchange (ToExchange)
 type Bind struct {
-	Queue      string `yaml:"queue"`
-	Exchange   string `yaml:"exchange"`
-	RoutingKey string `yaml:"key"`
+	Exchange   string                 `yaml:"exchange"`
+	Queue      string                 `yaml:"queue"`
+	ToExchange string                 `yaml:"to_exchange"`
+	RoutingKey string                 `yaml:"key"`
+	Arguments  map[string]interface{} `yaml:"arguments"`
+}
+
+func (bnd *Bind) Create(channel Declarer) error {
+	if bnd.ToExchange != "" {
+		log.Println("Binding exchange", bnd.ToExchange, "to exchange", bnd.Exchange, "with routing key", bnd.RoutingKey)
+		return channel.ExchangeBind(bnd.ToExchange, bnd.RoutingKey, bnd.Exchange, false, Table(bnd.Arguments))
+	}
+	log.Println("Binding queue", bnd.Queue, "to exchange", bnd.Exchange, "with routing key", bnd.RoutingKey)
+	return channel.QueueBind(bnd.Queue, bnd.RoutingKey, bnd.Exchange, false, Table(bnd.Arguments))
 }
 
 func (bnd *Bind) Serve(channel *amqp.Channel, ctx context.Context) error {
-	return channel.QueueBind(bnd.Queue, bnd.RoutingKey, bnd.Exchange, false, nil)
+	return bnd.Create(channel)
+}
+
+func (bnd *Bind) String() string {
+	target := "queue " + bnd.Queue
+	if bnd.ToExchange != "" {
+		target = "exchange " + bnd.ToExchange
+	}
+	return fmt.Sprintf("%v -[%v]-> %v", bnd.Exchange, bnd.RoutingKey, target)
 }
 
+// Infrastructure describes whole topology: exchanges are declared first, then queues and then explicit bindings
 type Infrastructure struct {
 	Exchanges []Exchange `yaml:"exchanges"`
 	Queues    []Queue    `yaml:"queues"`
 	Binds     []Bind     `yaml:"binds"`
 }
 
-func (inf *Infrastructure) Serve(channel *amqp.Channel, ctx context.Context) error {
-	for _, ex := range inf.Exchanges {
-		if err := ex.Serve(channel, ctx); err != nil {
+func (inf *Infrastructure) Create(channel Declarer) error {
+	for i := range inf.Exchanges {
+		if err := inf.Exchanges[i].Create(channel); err != nil {
 			return err
 		}
 	}
-	for _, q := range inf.Queues {
-		if err := q.Serve(channel, ctx); err != nil {
+	for i := range inf.Queues {
+		if err := inf.Queues[i].Create(channel); err != nil {
 			return err
 		}
 	}
-	for _, b := range inf.Binds {
-		if err := b.Serve(channel, ctx); err != nil {
+	for i := range inf.Binds {
+		if err := inf.Binds[i].Create(channel); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func (inf *Infrastructure) Serve(channel *amqp.Channel, ctx context.Context) error {
+	return inf.Create(channel)
+}
+
+// Bindings of topology in full form: binding maps of exchanges and queues and then explicit binds. Queue with
+// generated name is skipped, because its name is known only after declaration
+func (inf *Infrastructure) Bindings() []Bind {
+	var res []Bind
+	for _, ex := range inf.Exchanges {
+		for _, source := range sortedKeys(ex.Binding) {
+			for _, key := range ex.Binding[source] {
+				res = append(res, Bind{Exchange: source, ToExchange: ex.Name, RoutingKey: key})
+			}
+		}
+	}
+	for _, q := range inf.Queues {
+		if q.Name == "" {
+			continue
+		}
+		for _, exchange := range sortedKeys(q.Binding) {
+			for _, key := range q.Binding[exchange] {
+				res = append(res, Bind{Exchange: exchange, Queue: q.Name, RoutingKey: key})
+			}
+		}
+	}
+	return append(res, inf.Binds...)
+}
+
+func sortedKeys(binding map[string][]string) []string {
+	keys := make([]string, 0, len(binding))
+	for k := range binding {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Table converts YAML-decoded map (with nested map[interface{}]interface{}) to AMQP table
+func Table(values map[string]interface{}) amqp.Table {
+	if values == nil {
+		return nil
+	}
+	res := make(amqp.Table, len(values))
+	for k, v := range values {
+		res[k] = tableValue(v)
+	}
+	return res
+}
+
+func tableValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(amqp.Table, len(val))
+		for k, item := range val {
+			res[fmt.Sprint(k)] = tableValue(item)
+		}
+		return res
+	case map[string]interface{}:
+		return Table(val)
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = tableValue(item)
+		}
+		return res
+	case uint:
+		return int64(val)
+	case uint64:
+		return int64(val)
+	case uint32:
+		return int64(val)
+	case uint16:
+		return int32(val)
+	case int8:
+		return int16(val)
+	}
+	return v
+}
+
+// Exists checks exchange by passive declaration. Broker closes channel if exchange not exists, so separate channel
+// is used
+func (e *Exchange) Exists(conn *amqp.Connection) (bool, error) {
+	if e.IsDefault() {
+		return true, nil
+	}
+	if e.Type == "" {
+		e.Type = "topic"
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer channel.Close()
+	err = channel.ExchangeDeclarePassive(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, Table(e.Arguments))
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsPredeclared checks that exchange is created by broker (default or amq.*) and can't be removed
+func (e *Exchange) IsPredeclared() bool {
+	return e.IsDefault() || strings.HasPrefix(e.Name, "amq.")
+}
+
+func (e *Exchange) Delete(channel *amqp.Channel, ifUnused bool) error {
+	log.Println("Removing exchange", e)
+	return channel.ExchangeDelete(e.Name, ifUnused, false)
+}
+
+// Inspect queue by passive declaration in separate channel. Returns nil if queue not exists
+func (q *Queue) Inspect(conn *amqp.Connection) (*amqp.Queue, error) {
+	if q.Name == "" {
+		return nil, nil
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+	info, err := channel.QueueInspect(q.Name)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Delete queue and returns number of purged messages
+func (q *Queue) Delete(channel *amqp.Channel, ifUnused, ifEmpty bool) (int, error) {
+	log.Println("Removing queue", q.Name)
+	return channel.QueueDelete(q.Name, ifUnused, ifEmpty, false)
+}
+
+func (bnd *Bind) Delete(channel *amqp.Channel) error {
+	log.Println("Removing binding", bnd)
+	if bnd.ToExchange != "" {
+		return channel.ExchangeUnbind(bnd.ToExchange, bnd.RoutingKey, bnd.Exchange, false, Table(bnd.Arguments))
+	}
+	return channel.QueueUnbind(bnd.Queue, bnd.RoutingKey, bnd.Exchange, Table(bnd.Arguments))
+}
+
+// IsPreconditionFailed checks that error is broker's 406 (ex: deleted entity is in use or not empty)
+func IsPreconditionFailed(err error) bool {
+	if amqpErr, ok := err.(*amqp.Error); ok {
+		return amqpErr.Code == amqp.PreconditionFailed
+	}
+	return false
+}
+
+// IsNotFound checks that error is broker's 404 (entity not exists)
+func IsNotFound(err error) bool {
+	if amqpErr, ok := err.(*amqp.Error); ok {
+		return amqpErr.Code == amqp.NotFound
+	}
+	return false
+}
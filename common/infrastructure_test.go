@@ -0,0 +1,207 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDeprecatedKeys(t *testing.T) {
+	data := `
+exchanges:
+  - name: input
+    mode: fanout
+    autodelete: true
+queues:
+  - name: output
+    autoremove: true
+    bind:
+      - exchange: input
+        key: a
+      - exchange: input
+        key: b
+`
+	var inf Infrastructure
+	if err := yaml.Unmarshal([]byte(data), &inf); err != nil {
+		t.Fatal(err)
+	}
+	ex := inf.Exchanges[0]
+	if ex.Type != "fanout" || !ex.AutoDelete {
+		t.Fatalf("deprecated exchange keys ignored: %+v", ex)
+	}
+	q := inf.Queues[0]
+	if !q.AutoDelete || !reflect.DeepEqual(q.Binding, map[string][]string{"input": {"a", "b"}}) {
+		t.Fatalf("deprecated queue keys ignored: %+v", q)
+	}
+}
+
+func TestCurrentKeys(t *testing.T) {
+	data := `
+name: output
+auto_delete: true
+ttl: 1m
+binding:
+  input: [a]
+`
+	var q Queue
+	if err := yaml.Unmarshal([]byte(data), &q); err != nil {
+		t.Fatal(err)
+	}
+	if !q.AutoDelete || q.TTL != time.Minute || len(q.Binding["input"]) != 1 {
+		t.Fatalf("unexpected queue %+v", q)
+	}
+	if q.Args()["x-message-ttl"] != int64(60000) {
+		t.Fatalf("unexpected args %v", q.Args())
+	}
+}
+
+func TestTable(t *testing.T) {
+	var values map[string]interface{}
+	if err := yaml.Unmarshal([]byte("n: 1\nnested:\n  k: [1, x]\n"), &values); err != nil {
+		t.Fatal(err)
+	}
+	expected := amqp.Table{"n": 1, "nested": amqp.Table{"k": []interface{}{1, "x"}}}
+	if res := Table(values); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("unexpected table %#v", res)
+	}
+	if err := Table(values).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	data := `
+exchanges:
+  - name: events
+    binding:
+      input: [b, a]
+queues:
+  - name: output
+    binding:
+      events: [x]
+      alerts: [y]
+  - binding:
+      events: [generated]
+binds:
+  - exchange: input
+    queue: output
+    key: z
+`
+	var inf Infrastructure
+	if err := yaml.Unmarshal([]byte(data), &inf); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Bind{
+		{Exchange: "input", ToExchange: "events", RoutingKey: "b"},
+		{Exchange: "input", ToExchange: "events", RoutingKey: "a"},
+		{Exchange: "alerts", Queue: "output", RoutingKey: "y"},
+		{Exchange: "events", Queue: "output", RoutingKey: "x"},
+		{Exchange: "input", Queue: "output", RoutingKey: "z"},
+	}
+	if res := inf.Bindings(); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("unexpected bindings %+v", res)
+	}
+}
+
+// fakeDeclarer records declarations. Passive declaration of missing entity fails as on broker
+type fakeDeclarer struct {
+	calls   []string
+	missing map[string]bool
+}
+
+func (f *fakeDeclarer) record(format string, args ...interface{}) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeDeclarer) check(name string) error {
+	if f.missing[name] {
+		return &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no " + name}
+	}
+	return nil
+}
+
+func (f *fakeDeclarer) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.record("declare exchange %v %v auto_delete=%v", name, kind, autoDelete)
+	return nil
+}
+
+func (f *fakeDeclarer) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.record("check exchange %v", name)
+	return f.check(name)
+}
+
+func (f *fakeDeclarer) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	f.record("bind exchange %v -[%v]-> %v", source, key, destination)
+	return nil
+}
+
+func (f *fakeDeclarer) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	f.record("declare queue %v auto_delete=%v", name, autoDelete)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeDeclarer) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	f.record("check queue %v", name)
+	return amqp.Queue{Name: name}, f.check(name)
+}
+
+func (f *fakeDeclarer) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	f.record("bind queue %v -[%v]-> %v", exchange, key, name)
+	return nil
+}
+
+// passive entities of legacy configuration are checked, not skipped: missing passive entity fails declaration
+func TestDeprecatedKeysPassive(t *testing.T) {
+	data := `
+exchanges:
+  - name: input
+    mode: fanout
+    autodelete: true
+    passive: true
+  - name: events
+    mode: direct
+    autodelete: true
+queues:
+  - name: output
+    autoremove: true
+    passive: true
+    bind:
+      - exchange: input
+        key: a
+  - name: log
+    bind:
+      - exchange: events
+        key: b
+`
+	var inf Infrastructure
+	if err := yaml.Unmarshal([]byte(data), &inf); err != nil {
+		t.Fatal(err)
+	}
+	channel := &fakeDeclarer{}
+	if err := inf.Create(channel); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"check exchange input",
+		"declare exchange events direct auto_delete=true",
+		"check queue output",
+		"bind queue input -[a]-> output",
+		"declare queue log auto_delete=false",
+		"bind queue events -[b]-> log",
+	}
+	if !reflect.DeepEqual(channel.calls, expected) {
+		t.Fatalf("unexpected declarations:\n%v\nwant:\n%v", channel.calls, expected)
+	}
+
+	for _, name := range []string{"input", "output"} {
+		channel = &fakeDeclarer{missing: map[string]bool{name: true}}
+		err := inf.Create(channel)
+		if !IsNotFound(err) {
+			t.Errorf("missing passive %v: got error %v, want not found", name, err)
+		}
+	}
+}
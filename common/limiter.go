@@ -0,0 +1,89 @@
+package common
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimit is token bucket: Rate messages per second on average and up to Burst messages without delay
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (r *RateLimit) Enabled() bool {
+	return r.Rate > 0
+}
+
+// Reserve takes one token and returns delay before message can be sent
+func (r *RateLimit) Reserve() time.Duration {
+	if !r.Enabled() {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	burst := float64(r.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if r.last.IsZero() {
+		r.tokens = burst
+	} else {
+		r.tokens = math.Min(burst, r.tokens+now.Sub(r.last).Seconds()*r.Rate)
+	}
+	r.last = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.Rate * float64(time.Second))
+}
+
+// Wait until message can be sent. Returns context error if context done before
+func (r *RateLimit) Wait(ctx context.Context) error {
+	delay := r.Reserve()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ParseRate parses rate in format N/<unit> (ex: 100/s, 10/m, 5/100ms) or just N (per second)
+func ParseRate(value string) (float64, error) {
+	parts := strings.SplitN(value, "/", 2)
+	count, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "rate")
+	}
+	if len(parts) == 1 {
+		return count, nil
+	}
+	unit := strings.TrimSpace(parts[1])
+	if unit != "" && (unit[0] < '0' || unit[0] > '9') {
+		unit = "1" + unit
+	}
+	interval, err := time.ParseDuration(unit)
+	if err != nil {
+		return 0, errors.Wrap(err, "rate interval")
+	}
+	if interval <= 0 {
+		return 0, errors.New("rate interval should be positive")
+	}
+	return count / interval.Seconds(), nil
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		value string
+		rate  float64
+	}{
+		{"100", 100},
+		{"100/s", 100},
+		{"10/m", 10.0 / 60},
+		{"5/100ms", 50},
+		{" 2 / 2s ", 1},
+		{"1.5/s", 1.5},
+	}
+	for _, c := range cases {
+		rate, err := ParseRate(c.value)
+		if err != nil {
+			t.Errorf("%q: %v", c.value, err)
+			continue
+		}
+		if rate != c.rate {
+			t.Errorf("%q: got %v, want %v", c.value, rate, c.rate)
+		}
+	}
+	for _, value := range []string{"", "x/s", "10/x", "10/0s", "10/-1s"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	limit := &RateLimit{Rate: 10, Burst: 3}
+	for i := 0; i < 3; i++ {
+		if delay := limit.Reserve(); delay != 0 {
+			t.Fatalf("message %v of burst delayed by %v", i+1, delay)
+		}
+	}
+	delay := limit.Reserve()
+	if delay <= 0 || delay > 100*time.Millisecond {
+		t.Errorf("message after burst: got delay %v, want up to 100ms", delay)
+	}
+	delay = limit.Reserve()
+	if delay <= 100*time.Millisecond || delay > 200*time.Millisecond {
+		t.Errorf("second message after burst: got delay %v, want up to 200ms", delay)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	limit := &RateLimit{}
+	for i := 0; i < 100; i++ {
+		if delay := limit.Reserve(); delay != 0 {
+			t.Fatalf("disabled limit delayed by %v", delay)
+		}
+	}
+}
+
+func TestRateLimitWaitCanceled(t *testing.T) {
+	limit := &RateLimit{Rate: 0.001}
+	if err := limit.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limit.Wait(ctx); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
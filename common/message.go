@@ -2,8 +2,11 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"time"
+
+	"github.com/streadway/amqp"
 )
 
 type Message struct {
@@ -22,6 +25,73 @@ type Message struct {
 	Type            string    `json:"type,omitempty"`             // application use - message type name
 	Exchange        string    `json:"exchange,omitempty"`         // basic.publish exhange
 	RoutingKey      string    `json:"routing_key,omitempty"`      // basic.publish routing key
+	AppId           string    `json:"app_id,omitempty"`           // application use - creating application id
+	UserId          string    `json:"user_id,omitempty"`          // application use - creating user - should be authenticated user
+	Redelivered     bool      `json:"redelivered,omitempty"`      // delivery only - message was delivered before
+}
+
+// FromDelivery copies delivery body and properties to message
+func FromDelivery(msg amqp.Delivery) Message {
+	return Message{
+		Headers:         msg.Headers,
+		Body:            string(msg.Body),
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		Exchange:        msg.Exchange,
+		RoutingKey:      msg.RoutingKey,
+		AppId:           msg.AppId,
+		UserId:          msg.UserId,
+		Redelivered:     msg.Redelivered,
+	}
+}
+
+// Publishing restores message properties. Exchange, routing key and delivery-only fields are not part of publishing.
+// User ID is not restored: broker rejects message if it differs from user of connection
+func (m *Message) Publishing() amqp.Publishing {
+	return amqp.Publishing{
+		Body:            []byte(m.Body),
+		Headers:         Table(m.Headers),
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    m.DeliveryMode,
+		Priority:        m.Priority,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		Expiration:      m.Expiration,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Type:            m.Type,
+		AppId:           m.AppId,
+	}
+}
+
+// HeaderString formats header value: strings as is, tables and arrays as JSON
+func HeaderString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case nil:
+		return ""
+	case amqp.Table, map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+	return fmt.Sprint(value)
 }
 
 func (m *Message) Columns() ([]string, error) {
@@ -61,3 +131,27 @@ func MessageHeaders() []string {
 		"exchange",
 		"routingkey"}
 }
+
+// ToPublishing copies delivery body and properties to new message. Headers are copied too. User ID is not copied (see
+// Message.Publishing)
+func ToPublishing(msg amqp.Delivery) amqp.Publishing {
+	headers := make(amqp.Table, len(msg.Headers))
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
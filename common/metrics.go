@@ -0,0 +1,113 @@
+package common
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// OtherExchange is label of messages published to exchange taken from message instead of configuration. Clients can
+// not create unbounded number of series this way
+const OtherExchange = "other"
+
+// Metrics shared by all tools. They are collected always and exposed only by ServeMetrics
+var (
+	consumedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_consumed_total",
+		Help: "Messages received from queue",
+	}, []string{"queue"})
+	ackedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_acked_total",
+		Help: "Messages processed and acknowledged",
+	}, []string{"queue"})
+	nackedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_nacked_total",
+		Help: "Failed messages: rejected, requeued or passed to retry",
+	}, []string{"queue"})
+	publishedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amqp_messages_published_total",
+		Help: "Messages published (and confirmed in confirm mode)",
+	}, []string{"exchange"})
+	reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "amqp_reconnects_total",
+		Help: "Reconnects to broker after failure",
+	})
+	httpPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "amqp_http_push_duration_seconds",
+		Help: "Duration of HTTP push by status code (error - no response)",
+	}, []string{"code"})
+	scriptDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "amqp_script_duration_seconds",
+		Help: "Duration of script execution by exit code (timeout, killed - no exit code)",
+	}, []string{"exit_code"})
+	lastMessage int64
+)
+
+func init() {
+	prometheus.MustRegister(consumedMessages, ackedMessages, nackedMessages, publishedMessages, reconnects,
+		httpPushDuration, scriptDuration)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "amqp_seconds_since_last_message",
+		Help: "Time since last consumed message (-1 - no messages yet)",
+	}, func() float64 {
+		last := atomic.LoadInt64(&lastMessage)
+		if last == 0 {
+			return -1
+		}
+		return time.Since(time.Unix(0, last)).Seconds()
+	}))
+}
+
+// ServeMetrics exposes metrics in Prometheus format on /metrics in background. Empty address disables endpoint
+func ServeMetrics(address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Println("Metrics on", address)
+		log.Fatal(http.ListenAndServe(address, mux))
+	}()
+}
+
+func CountConsumed(queue string) {
+	consumedMessages.WithLabelValues(queue).Inc()
+	atomic.StoreInt64(&lastMessage, time.Now().UnixNano())
+}
+
+func CountAcked(queue string) {
+	ackedMessages.WithLabelValues(queue).Inc()
+}
+
+func CountNacked(queue string) {
+	nackedMessages.WithLabelValues(queue).Inc()
+}
+
+// CountPublished message. Exchange should be configured one or OtherExchange
+func CountPublished(exchange string) {
+	publishedMessages.WithLabelValues(exchange).Inc()
+}
+
+func CountReconnect() {
+	reconnects.Inc()
+}
+
+// ObserveHTTPPush records push duration. Zero status code means request failed without response
+func ObserveHTTPPush(statusCode int, duration time.Duration) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	httpPushDuration.WithLabelValues(code).Observe(duration.Seconds())
+}
+
+// ObserveScript records script duration by exit code or reason of failure without exit code
+func ObserveScript(exitCode string, duration time.Duration) {
+	scriptDuration.WithLabelValues(exitCode).Observe(duration.Seconds())
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"github.com/streadway/amqp"
+	"context"
 	"time"
 	"log"
 	"io/ioutil"
@@ -11,51 +12,46 @@ import (
 
 var StopReconnect = errors.New("Reconnect stopped by application")
 
-type Exchange struct {
-	Name       string `yaml:"name"`
-	Type       string `yaml:"type"`
-	Durable    bool   `yaml:"durable"`
-	AutoDelete bool   `yaml:"autodelete"`
-	Passive    bool   `yaml:"passive"`
-}
-
-func (e *Exchange) Create(channel *amqp.Channel) error {
-	if e.Passive {
-		return nil
-	}
-	if e.Type == "" {
-		e.Type = "topic"
-	}
-	log.Println("Creating exchange", e)
-	return channel.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, false, false, nil)
-}
-
-func (e *Exchange) String() string {
-	return e.Name + "@" + e.Type
-}
-
 type Reconnect struct {
 	Interval time.Duration  `yaml:"interval"`
 	Disable  bool           `yaml:"disable"`
 }
 
-func (r *Reconnect) Wait() {
-	if r.Interval == 0 {
-		time.Sleep(10 * time.Second)
-	} else {
-		time.Sleep(r.Interval)
+// Wait reconnect interval. Returns context error if context done before
+func (r *Reconnect) Wait(ctx context.Context) error {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	select {
+	case <-time.After(interval):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-type ChannelHandlerFunc func(channel *amqp.Channel) (error)
+type ChannelHandlerFunc func(channel *amqp.Channel, ctx context.Context) (error)
 
 type Connection struct {
-	URL       string    `yaml:"url"`
-	Reconnect Reconnect `yaml:"reconnect"`
-	Exchange  Exchange  `yaml:"exchange"`
+	URL          string         `yaml:"url"`
+	Reconnect    Reconnect      `yaml:"reconnect"`
+	Exchange     Exchange       `yaml:"exchange"`
+	Topology     Infrastructure `yaml:"topology"`
+	DrainTimeout time.Duration  `yaml:"drain_timeout"`
+
+	conn *amqp.Connection
 }
 
-func (c *Connection) connectionOpened(conn *amqp.Connection, handler ChannelHandlerFunc) error {
+func (c *Connection) drainTimeout() time.Duration {
+	if c.DrainTimeout == 0 {
+		return DefaultDrainTimeout
+	}
+	return c.DrainTimeout
+}
+
+// connectionOpened runs handler. After context done handler has drain timeout to finish before connection is closed
+func (c *Connection) connectionOpened(ctx context.Context, conn *amqp.Connection, handler ChannelHandlerFunc) error {
 	defer conn.Close()
 	ch, err := conn.Channel()
 	if err != nil {
@@ -63,36 +59,62 @@ func (c *Connection) connectionOpened(conn *amqp.Connection, handler ChannelHand
 	}
 	defer ch.Close()
 	log.Println("Channel opened")
-	return handler(ch)
-
+	c.conn = conn
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			select {
+			case <-finished:
+			case <-time.After(c.drainTimeout()):
+				log.Println("Drain timeout exceeded - closing connection")
+				conn.Close()
+			}
+		}
+	}()
+	return handler(ch, ctx)
 }
 
-func (c *Connection) Open(handler ChannelHandlerFunc) error {
+// Open connection and run handler. Reconnects until handler returns StopReconnect or context done. Error of the last
+// attempt is returned if context done after failure (ex: connection closed by drain timeout)
+func (c *Connection) Open(ctx context.Context, handler ChannelHandlerFunc) error {
 	for {
 		log.Println("Connecting to", c.URL)
 		conn, err := amqp.Dial(c.URL)
 		if err == nil {
 			log.Println("Connected")
-			err = c.connectionOpened(conn, handler)
+			err = c.connectionOpened(ctx, conn, handler)
 		}
 		if err == StopReconnect {
 			return nil
 		}
+		if ctx.Err() != nil {
+			return err
+		}
 		if !c.Reconnect.Disable {
 			log.Println("Stopped", err, ". Waiting...")
-			c.Reconnect.Wait()
+			if c.Reconnect.Wait(ctx) != nil {
+				return err
+			}
+			CountReconnect()
 		} else {
 			return err
 		}
 	}
 }
 
-func MustRead(configYamlFile string, v interface{}) {
+func Read(configYamlFile string, v interface{}) error {
 	data, err := ioutil.ReadFile(configYamlFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = yaml.Unmarshal(data, v)
+	return yaml.Unmarshal(data, v)
+}
+
+func MustRead(configYamlFile string, v interface{}) {
+	err := Read(configYamlFile, v)
 	if err != nil {
 		panic(err)
 	}
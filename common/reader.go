@@ -6,62 +6,19 @@ import (
 	"context"
 )
 
-type Queue struct {
-	Name          string `yaml:"name"`
-	Durable       bool   `yaml:"durable"`
-	AutoRemove    bool   `yaml:"autoremove"`
-	Exclusive     bool   `yaml:"exclusive"`
-	Lazy          bool   `yaml:"lazy"`
-	Passive       bool   `yaml:"passive"`
-	generatedName string
-	Binding       map[string][]string `yaml:"binding"`
-}
-
-func (q *Queue) RealName() string {
-	if q.generatedName == "" {
-		return q.Name
-	}
-	return q.generatedName
-}
-
-func (q *Queue) Create(channel *amqp.Channel) error {
-	if !q.Passive {
-		log.Println("Creating queue")
-		if q.Name == "" {
-			q.Durable = false
-			q.AutoRemove = true
-			q.Exclusive = true
-		}
-		args := make(amqp.Table)
-		if q.Lazy {
-			args["x-queue-mode"] = "lazy"
-		}
-		qq, err := channel.QueueDeclare(q.Name, q.Durable, q.AutoRemove, q.Exclusive, false, args)
-		if err != nil {
-			return err
-		}
-		q.generatedName = qq.Name
-		log.Println("Queue name", qq.Name)
-	}
-	for exchange, keys := range q.Binding {
-		for _, key := range keys {
-			log.Println("Binding queue to exchange", exchange, "with routing key", key)
-			err := channel.QueueBind(q.RealName(), key, exchange, false, nil)
-			if err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
 type Reader struct {
-	Connection  `yaml:",inline"`
-	Queue Queue `yaml:"queue"`
+	Connection `yaml:",inline"`
+	Queue      Queue `yaml:"queue"`
+	Retry      Retry `yaml:"retry"`
+	Prefetch   int   `yaml:"prefetch"` // maximum unacknowledged deliveries (0 - unlimited)
 }
 
 func (reader *Reader) Prepare(channel *amqp.Channel) error {
-	err := reader.Exchange.Create(channel)
+	err := reader.Topology.Create(channel)
+	if err != nil {
+		return err
+	}
+	err = reader.Exchange.Create(channel)
 	if err != nil {
 		return err
 	}
@@ -72,13 +29,20 @@ func (reader *Reader) Prepare(channel *amqp.Channel) error {
 	return nil
 }
 
-func (r *Reader) Consume(autoAck bool, handler func(<-chan amqp.Delivery) error) error {
-	return r.Open(func(channel *amqp.Channel) error {
+// Consume queue until context done. Consumer is cancelled on done, so handler should finish when stream closed
+func (r *Reader) Consume(ctx context.Context, autoAck bool, handler func(<-chan amqp.Delivery) error) error {
+	return r.Open(ctx, func(channel *amqp.Channel, ctx context.Context) error {
 		err := r.Prepare(channel)
 		if err != nil {
 			return err
 		}
-		stream, err := channel.Consume(r.Queue.RealName(), "", autoAck, false, false, false, nil)
+		if r.Prefetch > 0 {
+			err = channel.Qos(r.Prefetch, 0, false)
+			if err != nil {
+				return err
+			}
+		}
+		stream, err := ConsumeContext(ctx, channel, r.Queue.RealName(), "", autoAck, false)
 		if err != nil {
 			return err
 		}
@@ -87,6 +51,11 @@ func (r *Reader) Consume(autoAck bool, handler func(<-chan amqp.Delivery) error)
 	})
 }
 
+// Fail passes failed delivery to retry policy of reader. Must be called only inside Consume handler
+func (r *Reader) Fail(msg amqp.Delivery, reason error) error {
+	return r.Retry.Fail(r.conn, r.Queue.RealName(), msg, reason)
+}
+
 type ReaderFunc func(delivery amqp.Delivery) error
 
 type ReaderHandler interface {
@@ -109,7 +78,7 @@ func (cons *Consumer) SetHandler(handler ReaderHandler) {
 }
 
 func (cons *Consumer) Serve(channel *amqp.Channel, ctx context.Context) error {
-	delivery, err := channel.Consume(cons.Queue, cons.Name, false, cons.Exclusive, false, false, nil)
+	delivery, err := ConsumeContext(ctx, channel, cons.Queue, cons.Name, false, cons.Exclusive)
 	if err != nil {
 		return err
 	}
@@ -17,6 +17,7 @@ type ChannelHandler interface {
 type AConn struct {
 	URL              string
 	ReconnectTimeout time.Duration
+	DrainTimeout     time.Duration
 	handlers         []ChannelHandlerF
 }
 
@@ -33,7 +34,7 @@ func (ac *AConn) Serve(ctx context.Context) {
 LOOP:
 	for {
 		err := ac.openConnection(ctx)
-		if err == nil {
+		if err != nil {
 			logger.Println("Connection closed due to", err)
 		} else {
 			logger.Println("Connection closed due to no active tasks")
@@ -61,22 +62,31 @@ func (ac *AConn) openConnection(ctx context.Context) error {
 	}
 	defer channel.Close()
 
+	drainTimeout := ac.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = DefaultDrainTimeout
+	}
 	done := make(chan struct{}, 1)
 	go func() {
 		select {
 		case <-done:
 		case <-ctx.Done():
-			channel.Close()
-			conn.Close()
+			// give handlers time to finish in-flight messages
+			select {
+			case <-done:
+			case <-time.After(drainTimeout):
+				channel.Close()
+				conn.Close()
+			}
 		}
 	}()
 
+	defer close(done)
 	for _, handler := range ac.handlers {
 		err = handler(channel, ctx)
 		if err != nil {
 			return err
 		}
 	}
-	close(done)
 	return nil
 }
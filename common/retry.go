@@ -0,0 +1,197 @@
+package common
+
+import (
+	"flag"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+const RetryCountHeader = "x-retry-count"
+const RetryErrorHeader = "x-retry-error"
+
+// Retry policy. Failed delivery is republished to delay queue (per-message TTL, dead-lettered back to the source
+// queue) with exponential backoff. Number of attempts is kept in x-retry-count header. After all attempts message is
+// published to DeadLetter exchange or rejected without requeue (so queue's own DLX is used) if exchange not set
+type Retry struct {
+	Attempts      int           `yaml:"attempts"`
+	Delay         time.Duration `yaml:"delay"`
+	MaxDelay      time.Duration `yaml:"max_delay"`
+	Multiplier    float64       `yaml:"multiplier"`
+	DeadLetter    string        `yaml:"dead_letter"`
+	DeadLetterKey string        `yaml:"dead_letter_key"`
+}
+
+func (r *Retry) Enabled() bool {
+	return r.Attempts > 0
+}
+
+// Backoff returns delay before attempt (starts from 1)
+func (r *Retry) Backoff(attempt int) time.Duration {
+	delay := r.Delay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	multiplier := r.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	value := float64(delay) * math.Pow(multiplier, float64(attempt-1))
+	if r.MaxDelay > 0 && value > float64(r.MaxDelay) {
+		return r.MaxDelay
+	}
+	return time.Duration(value)
+}
+
+// Fail handles failed delivery from queue: schedules retry or moves message to dead letter. Original delivery is
+// acknowledged (or rejected) by this function, only after broker confirmed republished message. Consumer channel is
+// not used: every call works in own channels of connection, so it is safe for concurrent consumers
+func (r *Retry) Fail(conn *amqp.Connection, queue string, msg amqp.Delivery, reason error) error {
+	CountNacked(queue)
+	attempt := RetryCount(msg) + 1
+	pub := ToPublishing(msg)
+	pub.Headers[RetryCountHeader] = int32(attempt)
+	if reason != nil {
+		pub.Headers[RetryErrorHeader] = reason.Error()
+	}
+	if attempt > r.Attempts {
+		if r.DeadLetter == "" {
+			log.Println("Message", msg.MessageId, "rejected after", attempt-1, "retries")
+			return msg.Nack(false, false)
+		}
+		key := r.DeadLetterKey
+		if key == "" {
+			key = msg.RoutingKey
+		}
+		err := publishConfirmed(conn, r.DeadLetter, key, pub)
+		if err != nil {
+			return err
+		}
+		log.Println("Message", msg.MessageId, "moved to dead letter", r.DeadLetter, "after", attempt-1, "retries")
+		return msg.Ack(false)
+	}
+	delay := r.Backoff(attempt)
+	delayQueue := DelayQueue(queue, delay)
+	err := declareDelayQueue(conn, delayQueue, queue, delay)
+	if err != nil {
+		return err
+	}
+	pub.Expiration = strconv.FormatInt(int64(delay/time.Millisecond), 10)
+	err = publishConfirmed(conn, "", delayQueue, pub)
+	if err != nil {
+		return err
+	}
+	log.Println("Message", msg.MessageId, "will be retried after", delay, "( attempt", attempt, "of", r.Attempts, ")")
+	return msg.Ack(false)
+}
+
+// declareDelayQueue in separate channel. Broker closes channel if queue exists with other arguments (ex: declared by
+// older version without x-expires), such queue is used as is
+func declareDelayQueue(conn *amqp.Connection, name, queue string, delay time.Duration) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	_, err = channel.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+		"x-expires":                 int64(DelayQueueExpires(delay) / time.Millisecond),
+	})
+	if IsPreconditionFailed(err) {
+		log.Println("Delay queue", name, "exists with other arguments - used as is")
+		return nil
+	}
+	return err
+}
+
+// publishConfirmed publishes message in separate channel and waits broker confirmation
+func publishConfirmed(conn *amqp.Connection, exchange, routingKey string, msg amqp.Publishing) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	err = channel.Confirm(false)
+	if err != nil {
+		return err
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	err = channel.Publish(exchange, routingKey, false, false, msg)
+	if err != nil {
+		return err
+	}
+	confirm, ok := <-confirms
+	if !ok {
+		return errors.New("Channel closed before confirmation")
+	}
+	if !confirm.Ack {
+		return MessageNacked
+	}
+	return nil
+}
+
+// DelayQueue name for source queue. Each delay uses own queue, so per-message TTL never blocks shorter delays
+func DelayQueue(queue string, delay time.Duration) string {
+	return queue + ".retry." + delay.String()
+}
+
+// DelayQueueExpires is idle time after which broker removes delay queue (queue is re-declared on each retry). It is
+// twice the delay but not less than a minute, so pending messages are dead-lettered before queue goes away
+func DelayQueueExpires(delay time.Duration) time.Duration {
+	expires := 2 * delay
+	if expires < time.Minute {
+		expires = time.Minute
+	}
+	return expires
+}
+
+// RetryCount of delivery from x-retry-count header
+func RetryCount(msg amqp.Delivery) int {
+	switch v := msg.Headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		// headers decoded from JSON
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// FlagRetry registers retry policy flags
+func FlagRetry() *Retry {
+	r := &Retry{}
+	flag.IntVar(&r.Attempts, "retry-attempts", 0, "Number of retries through delay queues (0 - disabled)")
+	flag.DurationVar(&r.Delay, "retry-delay", time.Second, "Delay before first retry")
+	flag.DurationVar(&r.MaxDelay, "retry-max-delay", time.Hour, "Maximum delay between retries")
+	flag.Float64Var(&r.Multiplier, "retry-multiplier", 2, "Delay multiplier for each next retry")
+	flag.StringVar(&r.DeadLetter, "dead-letter", "", "Exchange for messages after all retries (empty - reject)")
+	flag.StringVar(&r.DeadLetterKey, "dead-letter-key", "", "Routing key for dead letters (empty - original)")
+	return r
+}
+
+// KingpinRetry registers the same retry policy flags as FlagRetry for kingpin application
+func KingpinRetry(app *kingpin.Application) *Retry {
+	r := &Retry{}
+	app.Flag("retry-attempts", "Number of retries through delay queues (0 - disabled)").Default("0").IntVar(&r.Attempts)
+	app.Flag("retry-delay", "Delay before first retry").Default("1s").DurationVar(&r.Delay)
+	app.Flag("retry-max-delay", "Maximum delay between retries").Default("1h").DurationVar(&r.MaxDelay)
+	app.Flag("retry-multiplier", "Delay multiplier for each next retry").Default("2").Float64Var(&r.Multiplier)
+	app.Flag("dead-letter", "Exchange for messages after all retries (empty - reject)").StringVar(&r.DeadLetter)
+	app.Flag("dead-letter-key", "Routing key for dead letters (empty - original)").StringVar(&r.DeadLetterKey)
+	return r
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	r := &Retry{Delay: time.Second, MaxDelay: 10 * time.Second, Multiplier: 3}
+	expected := []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, delay := range expected {
+		if got := r.Backoff(i + 1); got != delay {
+			t.Errorf("attempt %v: got %v, want %v", i+1, got, delay)
+		}
+	}
+	// defaults: 1s delay, multiplier 2, no maximum
+	r = &Retry{}
+	expected = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 1024 * time.Second}
+	for i, attempt := range []int{1, 2, 3, 11} {
+		if got := r.Backoff(attempt); got != expected[i] {
+			t.Errorf("default attempt %v: got %v, want %v", attempt, got, expected[i])
+		}
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	if DelayQueue("jobs", 1500*time.Millisecond) != "jobs.retry.1.5s" {
+		t.Error("unexpected delay queue name", DelayQueue("jobs", 1500*time.Millisecond))
+	}
+}
+
+func TestDelayQueueExpires(t *testing.T) {
+	if got := DelayQueueExpires(time.Second); got != time.Minute {
+		t.Errorf("short delay: got %v, want %v", got, time.Minute)
+	}
+	if got := DelayQueueExpires(time.Hour); got != 2*time.Hour {
+		t.Errorf("long delay: got %v, want %v", got, 2*time.Hour)
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	values := []interface{}{int(2), int16(2), int32(2), int64(2), float64(2), "2"}
+	for _, value := range values {
+		msg := amqp.Delivery{Headers: amqp.Table{RetryCountHeader: value}}
+		if got := RetryCount(msg); got != 2 {
+			t.Errorf("%T: got %v, want 2", value, got)
+		}
+	}
+	if got := RetryCount(amqp.Delivery{}); got != 0 {
+		t.Errorf("no header: got %v, want 0", got)
+	}
+}
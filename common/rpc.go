@@ -0,0 +1,286 @@
+package common
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+)
+
+// Reply headers of RPC protocol. Failed request is answered by reply with error header (text of error) and optional
+// error-kind header (class of failure, ex: exit, timeout). Streamed replies share correlation ID of request, the last
+// one has x-stream-end header
+const (
+	ErrorHeader      = "error"
+	ErrorKindHeader  = "error-kind"
+	StreamEndHeader  = "x-stream-end"
+	DirectReplyQueue = "amq.rabbitmq.reply-to"
+)
+
+var RPCClientStopped = errors.New("RPC client stopped")
+var RPCConnectionLost = errors.New("Connection lost before reply")
+
+var stopStream = errors.New("Stream stopped")
+
+// RPCError is failure reported by RPC server in reply headers
+type RPCError struct {
+	Message string
+	Kind    string
+}
+
+func (e *RPCError) Error() string {
+	if e.Kind == "" {
+		return e.Message
+	}
+	return e.Kind + ": " + e.Message
+}
+
+// ReplyError returns RPCError if reply has error header, otherwise nil
+func ReplyError(msg amqp.Delivery) error {
+	value, ok := msg.Headers[ErrorHeader]
+	if !ok {
+		return nil
+	}
+	res := &RPCError{Message: HeaderString(value)}
+	if kind, ok := msg.Headers[ErrorKindHeader]; ok {
+		res.Kind = HeaderString(kind)
+	}
+	return res
+}
+
+// ErrorReply builds reply for failed request. Kind is taken from RPCError
+func ErrorReply(request amqp.Delivery, err error) amqp.Publishing {
+	headers := amqp.Table{ErrorHeader: err.Error()}
+	if failed, ok := err.(*RPCError); ok {
+		headers[ErrorHeader] = failed.Message
+		if failed.Kind != "" {
+			headers[ErrorKindHeader] = failed.Kind
+		}
+	}
+	return amqp.Publishing{
+		MessageId:     uuid.NewV4().String(),
+		Timestamp:     time.Now(),
+		CorrelationId: request.CorrelationId,
+		Headers:       headers,
+		Body:          []byte(err.Error()),
+	}
+}
+
+// IsStreamEnd checks that reply is last in stream: has x-stream-end header which is not false
+func IsStreamEnd(msg amqp.Delivery) bool {
+	value, ok := msg.Headers[StreamEndHeader]
+	if !ok {
+		return false
+	}
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v != "false" && v != "0"
+	}
+	return true
+}
+
+// RPCClient sends requests to RoutingKey and waits replies in temporary exclusive queue (or direct reply-to).
+// Replies are matched by correlation ID. Calls in progress fail with RPCConnectionLost on reconnect
+type RPCClient struct {
+	Connection                `yaml:",inline"`
+	RoutingKey  string        `yaml:"routing_key"`
+	Timeout     time.Duration `yaml:"timeout"`
+	DirectReply bool          `yaml:"direct_reply"`
+
+	requests chan *rpcCall
+	stopped  chan struct{}
+	lock     sync.Mutex
+	calls    map[string]*rpcCall
+}
+
+type rpcCall struct {
+	msg       amqp.Publishing
+	replies   chan amqp.Delivery
+	failed    chan error
+	finished  chan struct{}
+	published bool
+}
+
+func (c *RPCClient) Init() {
+	c.requests = make(chan *rpcCall)
+	c.stopped = make(chan struct{})
+	c.calls = make(map[string]*rpcCall)
+}
+
+func (c *RPCClient) Prepare(channel *amqp.Channel) error {
+	err := c.Topology.Create(channel)
+	if err != nil {
+		return err
+	}
+	return c.Exchange.Create(channel)
+}
+
+// Run publishing and replies dispatching loop until client closed
+func (c *RPCClient) Run(ctx context.Context) error {
+	defer close(c.stopped)
+	return c.Open(ctx, func(channel *amqp.Channel, ctx context.Context) error {
+		err := c.Prepare(channel)
+		if err != nil {
+			return err
+		}
+		replyTo := DirectReplyQueue
+		if !c.DirectReply {
+			q := Queue{}
+			err = q.Create(channel)
+			if err != nil {
+				return err
+			}
+			replyTo = q.RealName()
+		}
+		// direct reply-to requires consumer before publishing
+		stream, err := channel.Consume(replyTo, "", true, true, false, false, nil)
+		if err != nil {
+			return err
+		}
+		defer c.lost()
+		for {
+			select {
+			case call, ok := <-c.requests:
+				if !ok {
+					return StopReconnect
+				}
+				call.msg.ReplyTo = replyTo
+				err = channel.Publish(c.Exchange.Name, c.RoutingKey, false, false, call.msg)
+				if err != nil {
+					call.failed <- err
+					return err
+				}
+				c.markPublished(call)
+			case msg, ok := <-stream:
+				if !ok {
+					return errors.New("Reply stream closed")
+				}
+				c.dispatch(msg)
+			}
+		}
+	})
+}
+
+// markPublished makes call sensitive to connection loss
+func (c *RPCClient) markPublished(call *rpcCall) {
+	c.lock.Lock()
+	call.published = true
+	c.lock.Unlock()
+}
+
+// dispatch passes reply to waiting call. Slow stream consumer blocks other replies
+func (c *RPCClient) dispatch(msg amqp.Delivery) {
+	c.lock.Lock()
+	call, ok := c.calls[msg.CorrelationId]
+	c.lock.Unlock()
+	if !ok {
+		log.Println("Ignore stray reply", msg.MessageId, "with correlation id", msg.CorrelationId)
+		return
+	}
+	select {
+	case call.replies <- msg:
+	case <-call.finished:
+	}
+}
+
+// lost fails calls sent over closed channel: replies to them will never come
+func (c *RPCClient) lost() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, call := range c.calls {
+		if !call.published {
+			continue
+		}
+		select {
+		case call.failed <- RPCConnectionLost:
+		default:
+		}
+	}
+}
+
+// Call sends request and waits for single reply. Reply with error header is returned together with RPCError
+func (c *RPCClient) Call(ctx context.Context, msg amqp.Publishing) (amqp.Delivery, error) {
+	var res amqp.Delivery
+	err := c.Stream(ctx, msg, func(reply amqp.Delivery) error {
+		res = reply
+		return stopStream
+	})
+	if err == stopStream {
+		err = ReplyError(res)
+	}
+	return res, err
+}
+
+// Stream sends request and passes replies to handler until reply with x-stream-end header or error header.
+// Handler error stops receiving. Client timeout (if set) limits whole call
+func (c *RPCClient) Stream(ctx context.Context, msg amqp.Publishing, handler func(reply amqp.Delivery) error) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = uuid.NewV4().String()
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.NewV4().String()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	call := &rpcCall{
+		msg:      msg,
+		replies:  make(chan amqp.Delivery),
+		failed:   make(chan error, 1),
+		finished: make(chan struct{}),
+	}
+	c.lock.Lock()
+	c.calls[msg.CorrelationId] = call
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, msg.CorrelationId)
+		c.lock.Unlock()
+		close(call.finished)
+	}()
+
+	select {
+	case c.requests <- call:
+	case <-c.stopped:
+		return RPCClientStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for {
+		select {
+		case reply := <-call.replies:
+			err := handler(reply)
+			if err != nil {
+				return err
+			}
+			if err = ReplyError(reply); err != nil {
+				return err
+			}
+			if IsStreamEnd(reply) {
+				return nil
+			}
+		case err := <-call.failed:
+			return err
+		case <-c.stopped:
+			return RPCClientStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *RPCClient) Close() error {
+	close(c.requests)
+	return nil
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// serveFake replaces Run loop: every request is marked published and passed to respond instead of broker
+func serveFake(client *RPCClient, respond func(call *rpcCall)) {
+	go func() {
+		for call := range client.requests {
+			client.markPublished(call)
+			respond(call)
+		}
+	}()
+}
+
+func newFakeClient() *RPCClient {
+	client := &RPCClient{Timeout: 5 * time.Second}
+	client.Init()
+	return client
+}
+
+func TestRPCErrorRoundTrip(t *testing.T) {
+	request := amqp.Delivery{CorrelationId: "42"}
+	reply := ErrorReply(request, &RPCError{Message: "script failed", Kind: "timeout"})
+	if reply.CorrelationId != "42" {
+		t.Fatalf("correlation id %q", reply.CorrelationId)
+	}
+	err := ReplyError(amqp.Delivery{Headers: reply.Headers, CorrelationId: reply.CorrelationId})
+	failed, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("expected RPCError, got %#v", err)
+	}
+	if failed.Message != "script failed" || failed.Kind != "timeout" {
+		t.Fatalf("unexpected error %#v", failed)
+	}
+	if failed.Error() != "timeout: script failed" {
+		t.Fatalf("unexpected text %q", failed.Error())
+	}
+
+	reply = ErrorReply(request, errors.New("plain"))
+	err = ReplyError(amqp.Delivery{Headers: reply.Headers})
+	if failed, ok := err.(*RPCError); !ok || failed.Message != "plain" || failed.Kind != "" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if ReplyError(amqp.Delivery{Headers: amqp.Table{"other": "x"}}) != nil {
+		t.Fatal("reply without error header is not an error")
+	}
+}
+
+func TestIsStreamEnd(t *testing.T) {
+	cases := map[interface{}]bool{true: true, false: false, "true": true, "false": false, "0": false, int32(1): true}
+	for value, expected := range cases {
+		if IsStreamEnd(amqp.Delivery{Headers: amqp.Table{StreamEndHeader: value}}) != expected {
+			t.Errorf("%#v: expected %v", value, expected)
+		}
+	}
+	if IsStreamEnd(amqp.Delivery{}) {
+		t.Error("no header is not stream end")
+	}
+}
+
+func TestRPCClientCorrelation(t *testing.T) {
+	client := newFakeClient()
+	defer client.Close()
+	serveFake(client, func(call *rpcCall) {
+		// stray reply is ignored, matching one is returned
+		client.dispatch(amqp.Delivery{CorrelationId: "stray", Body: []byte("wrong")})
+		client.dispatch(amqp.Delivery{CorrelationId: call.msg.CorrelationId, Body: []byte("pong")})
+	})
+	reply, err := client.Call(context.Background(), amqp.Publishing{Body: []byte("ping")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Body) != "pong" {
+		t.Fatalf("unexpected reply %q", reply.Body)
+	}
+}
+
+func TestRPCClientStream(t *testing.T) {
+	client := newFakeClient()
+	defer client.Close()
+	serveFake(client, func(call *rpcCall) {
+		id := call.msg.CorrelationId
+		client.dispatch(amqp.Delivery{CorrelationId: id, Body: []byte("1")})
+		client.dispatch(amqp.Delivery{CorrelationId: id, Body: []byte("2")})
+		client.dispatch(amqp.Delivery{CorrelationId: id, Body: []byte("3"), Headers: amqp.Table{StreamEndHeader: true}})
+	})
+	var got string
+	err := client.Stream(context.Background(), amqp.Publishing{CorrelationId: "fixed"}, func(reply amqp.Delivery) error {
+		got += string(reply.Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "123" {
+		t.Fatalf("unexpected replies %q", got)
+	}
+}
+
+func TestRPCClientErrorReply(t *testing.T) {
+	client := newFakeClient()
+	defer client.Close()
+	serveFake(client, func(call *rpcCall) {
+		request := amqp.Delivery{CorrelationId: call.msg.CorrelationId}
+		reply := ErrorReply(request, &RPCError{Message: "exit status 2", Kind: "exit"})
+		client.dispatch(amqp.Delivery{CorrelationId: reply.CorrelationId, Headers: reply.Headers, Body: reply.Body})
+	})
+	_, err := client.Call(context.Background(), amqp.Publishing{})
+	failed, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("expected RPCError, got %#v", err)
+	}
+	if failed.Kind != "exit" || failed.Message != "exit status 2" {
+		t.Fatalf("unexpected error %#v", failed)
+	}
+}
+
+func TestRPCClientConnectionLost(t *testing.T) {
+	client := newFakeClient()
+	defer client.Close()
+	serveFake(client, func(call *rpcCall) {
+		// channel closed after publishing: reply will never come
+		client.lost()
+	})
+	_, err := client.Call(context.Background(), amqp.Publishing{})
+	if err != RPCConnectionLost {
+		t.Fatalf("expected connection lost, got %v", err)
+	}
+}
+
+func TestRPCClientTimeout(t *testing.T) {
+	client := newFakeClient()
+	client.Timeout = 50 * time.Millisecond
+	defer client.Close()
+	serveFake(client, func(call *rpcCall) {})
+	_, err := client.Call(context.Background(), amqp.Publishing{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if len(client.calls) != 0 {
+		t.Fatal("finished call is not removed")
+	}
+}
+
+func TestRPCClientStopped(t *testing.T) {
+	client := newFakeClient()
+	close(client.stopped)
+	_, err := client.Call(context.Background(), amqp.Publishing{})
+	if err != RPCClientStopped {
+		t.Fatalf("expected stopped, got %v", err)
+	}
+}
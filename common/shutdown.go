@@ -0,0 +1,86 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const DefaultDrainTimeout = 30 * time.Second
+
+// SignalContext returns context which is canceled on SIGINT or SIGTERM. Second signal terminates application immediately
+func SignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Println("Got", sig, "- shutting down")
+		cancel()
+		sig = <-signals
+		log.Println("Got", sig, "again - exit immediately")
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// DrainContext is canceled after timeout since parent context is done. It limits in-flight work (subprocesses,
+// HTTP requests) during shutdown
+func DrainContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	drain, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drain.Done():
+			return
+		}
+		select {
+		case <-time.After(timeout):
+			cancel()
+		case <-drain.Done():
+		}
+	}()
+	return drain, cancel
+}
+
+// ConsumeContext starts consumer which is cancelled when context is done: broker stops deliveries and stream is closed,
+// so handler can finish in-flight messages. Empty consumer name is replaced by unique tag
+func ConsumeContext(ctx context.Context, channel *amqp.Channel, queue, consumer string, autoAck, exclusive bool) (<-chan amqp.Delivery, error) {
+	if consumer == "" {
+		consumer = fmt.Sprintf("ctag-%v-%v", os.Getpid(), time.Now().UnixNano())
+	}
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	stream, err := channel.Consume(queue, consumer, autoAck, exclusive, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping consumer", consumer)
+			channel.Cancel(consumer, false)
+		case <-closed:
+		}
+	}()
+	// count deliveries for metrics when handed to consumer. Forwarding stops on channel close even if nobody reads
+	// anymore
+	counted := make(chan amqp.Delivery)
+	go func() {
+		defer close(counted)
+		for msg := range stream {
+			select {
+			case counted <- msg:
+				CountConsumed(queue)
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return counted, nil
+}
@@ -0,0 +1,201 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// TypedTable is AMQP table which keeps types of values in JSON
+type TypedTable map[string]TypedValue
+
+// TypedValue is AMQP field value encoded in JSON with its type: {"type": "int", "value": 1}. Plain JSON values (without
+// type) are decoded too: integral numbers as long, other numbers as double, objects as tables
+type TypedValue struct {
+	Value interface{}
+}
+
+type typedJSON struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type decimalJSON struct {
+	Scale uint8 `json:"scale"`
+	Value int32 `json:"value"`
+}
+
+func NewTypedTable(table amqp.Table) TypedTable {
+	if table == nil {
+		return nil
+	}
+	res := make(TypedTable, len(table))
+	for k, v := range table {
+		res[k] = TypedValue{Value: v}
+	}
+	return res
+}
+
+func (t TypedTable) Table() amqp.Table {
+	if t == nil {
+		return nil
+	}
+	res := make(amqp.Table, len(t))
+	for k, v := range t {
+		res[k] = v.Value
+	}
+	return res
+}
+
+func (tv TypedValue) MarshalJSON() ([]byte, error) {
+	res := typedJSON{Value: tv.Value}
+	switch v := tv.Value.(type) {
+	case nil:
+		res.Type = "void"
+	case bool:
+		res.Type = "bool"
+	case byte:
+		res.Type = "byte"
+	case int16:
+		res.Type = "short"
+	case int32:
+		res.Type = "int"
+	case int:
+		// encoded by driver as 32-bit integer
+		res.Type, res.Value = "int", int32(v)
+	case int64:
+		res.Type = "long"
+	case float32:
+		res.Type = "float"
+	case float64:
+		res.Type = "double"
+	case amqp.Decimal:
+		res.Type, res.Value = "decimal", decimalJSON{Scale: v.Scale, Value: v.Value}
+	case string:
+		res.Type = "string"
+	case []byte:
+		res.Type = "bytes"
+	case time.Time:
+		res.Type = "timestamp"
+	case amqp.Table:
+		res.Type, res.Value = "table", NewTypedTable(v)
+	case []interface{}:
+		items := make([]TypedValue, len(v))
+		for i, item := range v {
+			items[i] = TypedValue{Value: item}
+		}
+		res.Type, res.Value = "array", items
+	default:
+		return nil, errors.Errorf("unsupported AMQP value type %T", v)
+	}
+	return json.Marshal(res)
+}
+
+func (tv *TypedValue) UnmarshalJSON(data []byte) error {
+	var typed struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}
+	if json.Unmarshal(data, &typed) == nil && typed.Type != "" {
+		value, known, err := decodeTyped(typed.Type, typed.Value)
+		if err != nil {
+			return errors.Wrapf(err, "decode %v value", typed.Type)
+		}
+		if known {
+			tv.Value = value
+			return nil
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var plain interface{}
+	err := decoder.Decode(&plain)
+	if err != nil {
+		return err
+	}
+	tv.Value = plainValue(plain)
+	return nil
+}
+
+// decodeTyped value of known type. Unknown type is reported by false
+func decodeTyped(typ string, raw json.RawMessage) (interface{}, bool, error) {
+	var target interface{}
+	switch typ {
+	case "void":
+		return nil, true, nil
+	case "bool":
+		target = new(bool)
+	case "byte":
+		target = new(byte)
+	case "short":
+		target = new(int16)
+	case "int":
+		target = new(int32)
+	case "long":
+		target = new(int64)
+	case "float":
+		target = new(float32)
+	case "double":
+		target = new(float64)
+	case "decimal":
+		target = new(decimalJSON)
+	case "string":
+		target = new(string)
+	case "bytes":
+		target = new([]byte)
+	case "timestamp":
+		target = new(time.Time)
+	case "table":
+		target = new(TypedTable)
+	case "array":
+		target = new([]TypedValue)
+	default:
+		return nil, false, nil
+	}
+	err := json.Unmarshal(raw, target)
+	if err != nil {
+		return nil, true, err
+	}
+	switch v := target.(type) {
+	case *decimalJSON:
+		return amqp.Decimal{Scale: v.Scale, Value: v.Value}, true, nil
+	case *TypedTable:
+		return v.Table(), true, nil
+	case *[]TypedValue:
+		items := make([]interface{}, len(*v))
+		for i, item := range *v {
+			items[i] = item.Value
+		}
+		return items, true, nil
+	}
+	return reflect.ValueOf(target).Elem().Interface(), true, nil
+}
+
+// plainValue converts JSON value decoded with UseNumber to AMQP value
+func plainValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return n
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		res := make(amqp.Table, len(val))
+		for k, item := range val {
+			res[k] = plainValue(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = plainValue(item)
+		}
+		return res
+	}
+	return v
+}
@@ -2,49 +2,186 @@ package common
 
 import (
 	"github.com/streadway/amqp"
+	"github.com/pkg/errors"
 	"context"
 	"time"
 	"log"
-	"os"
 )
 
+var MessageNacked = errors.New("Message rejected by broker")
+var MessageReturned = errors.New("Message returned by broker as unroutable")
+var WriterStopped = errors.New("Writer stopped")
+
+type Confirm struct {
+	Enable  bool          `yaml:"enable"`
+	Retries int           `yaml:"retries"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
 type Writer struct {
-	Connection        `yaml:",inline"`
-	RoutingKey string `yaml:"routing_key"`
+	Connection           `yaml:",inline"`
+	RoutingKey string    `yaml:"routing_key"`
+	Mandatory  bool      `yaml:"mandatory"`
+	Confirm    Confirm   `yaml:"confirm"`
+	Rate       RateLimit `yaml:"rate"`
+
+	data    chan *publishing
+	stopped chan struct{}
+	pending *publishing
+}
 
-	data chan amqp.Publishing
+type publishing struct {
+	exchange   string
+	routingKey string
+	msg        amqp.Publishing
+	attempt    int
+	done       chan error
 }
 
 func (w *Writer) Init() {
-	w.data = make(chan amqp.Publishing)
+	w.data = make(chan *publishing)
+	w.stopped = make(chan struct{})
 }
 
 func (writer *Writer) Prepare(channel *amqp.Channel) error {
-	err := writer.Exchange.Create(channel)
+	err := writer.Topology.Create(channel)
+	if err != nil {
+		return err
+	}
+	err = writer.Exchange.Create(channel)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (wr *Writer) Run() error {
-	return wr.Open(func(channel *amqp.Channel) error {
+// Run publishing loop until writer closed. Context only stops reconnects: producer should close writer on done
+func (wr *Writer) Run(ctx context.Context) error {
+	defer close(wr.stopped)
+	err := wr.Open(ctx, func(channel *amqp.Channel, ctx context.Context) error {
 		err := wr.Prepare(channel)
 		if err != nil {
 			return err
 		}
-		for msg := range wr.data {
-			err := channel.Publish(wr.Exchange.Name, wr.RoutingKey, false, false, msg)
+		var confirms chan amqp.Confirmation
+		var returns chan amqp.Return
+		if wr.Mandatory {
+			returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+		}
+		if wr.Confirm.Enable {
+			err = channel.Confirm(false)
+			if err != nil {
+				return err
+			}
+			confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+		} else if returns != nil {
+			// without confirms returns can't be matched to Write calls
+			go func() {
+				for ret := range returns {
+					log.Println("Message", ret.MessageId, "returned:", ret.ReplyText)
+				}
+			}()
+		}
+		for {
+			if wr.pending == nil {
+				msg, ok := <-wr.data
+				if !ok {
+					return StopReconnect
+				}
+				wr.pending = msg
+			}
+			err = wr.publish(channel, confirms, returns)
 			if err != nil {
 				return err
 			}
 		}
-		return StopReconnect
 	})
+	if wr.pending != nil {
+		// message was not published (or not confirmed) before stop
+		if err == nil {
+			err = WriterStopped
+		}
+		wr.complete(err)
+	}
+	return err
 }
 
-func (wr *Writer) Write(msg amqp.Publishing) {
-	wr.data <- msg
+// publish sends pending message. Returned error means channel failure: pending message is kept and will be sent again
+// after reconnect
+func (wr *Writer) publish(channel *amqp.Channel, confirms chan amqp.Confirmation, returns chan amqp.Return) error {
+	err := channel.Publish(wr.pending.exchange, wr.pending.routingKey, wr.Mandatory, false, wr.pending.msg)
+	if err != nil {
+		return err
+	}
+	if confirms == nil {
+		wr.complete(nil)
+		return nil
+	}
+	var timeout <-chan time.Time
+	if wr.Confirm.Timeout > 0 {
+		timeout = time.After(wr.Confirm.Timeout)
+	}
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			return errors.New("Channel closed before confirmation")
+		}
+		// broker sends basic.return before basic.ack for the same message
+		select {
+		case ret := <-returns:
+			wr.complete(errors.Wrap(MessageReturned, ret.ReplyText))
+			return nil
+		default:
+		}
+		if confirm.Ack {
+			wr.complete(nil)
+			return nil
+		}
+		wr.pending.attempt++
+		log.Println("Message", wr.pending.msg.MessageId, "nacked by broker, attempt", wr.pending.attempt)
+		if wr.pending.attempt > wr.Confirm.Retries {
+			wr.complete(MessageNacked)
+		}
+		return nil
+	case <-timeout:
+		return errors.New("Confirmation timeout")
+	}
+}
+
+func (wr *Writer) complete(err error) {
+	if err == nil {
+		label := wr.pending.exchange
+		if label != wr.Exchange.Name {
+			label = OtherExchange
+		}
+		CountPublished(label)
+	}
+	wr.pending.done <- err
+	wr.pending = nil
+}
+
+// Write publishes message and waits for result. In confirm mode the result is known only after broker acknowledgement.
+// Rate limit (if set) delays write
+func (wr *Writer) Write(msg amqp.Publishing) error {
+	return wr.WriteTo(wr.Exchange.Name, wr.RoutingKey, msg)
+}
+
+// WriteTo publishes message to another exchange or routing key. Exchange is not declared
+func (wr *Writer) WriteTo(exchange, routingKey string, msg amqp.Publishing) error {
+	if delay := wr.Rate.Reserve(); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-wr.stopped:
+			return WriterStopped
+		}
+	}
+	req := &publishing{exchange: exchange, routingKey: routingKey, msg: msg, done: make(chan error, 1)}
+	select {
+	case wr.data <- req:
+	case <-wr.stopped:
+		return WriterStopped
+	}
+	return <-req.done
 }
 
 func (writer *Writer) Close() error {
@@ -12,6 +12,7 @@ import (
 	"os"
 	"github.com/alecthomas/kingpin"
 	"net/mail"
+	"context"
 )
 
 type IMAP struct {
@@ -32,7 +33,7 @@ func convertAddress(list []*imap.Address) []interface{} {
 	return res
 }
 
-func (im *IMAP) onConection(conn *client.Client, writer *common.Writer) error {
+func (im *IMAP) onConection(ctx context.Context, conn *client.Client, writer *common.Writer) error {
 	defer conn.Close()
 	log.Println("Logging...")
 	err := conn.Login(im.User, im.Password)
@@ -42,7 +43,7 @@ func (im *IMAP) onConection(conn *client.Client, writer *common.Writer) error {
 	log.Println("Successfully logged in")
 	defer conn.Logout()
 
-	for {
+	for ctx.Err() == nil {
 		log.Println("Openning", im.Mailbox)
 		mbox, err := conn.Select(im.Mailbox, false)
 		if err != nil {
@@ -95,7 +96,9 @@ func (im *IMAP) onConection(conn *client.Client, writer *common.Writer) error {
 					ContentType:     contentType,
 					ContentEncoding: msg.BodyStructure.Encoding,
 				}
-				writer.Write(msg)
+				if err := writer.Write(msg); err != nil {
+					return err
+				}
 			}
 			log.Println("Done fetching")
 			if err := <-done; err != nil {
@@ -108,14 +111,17 @@ func (im *IMAP) onConection(conn *client.Client, writer *common.Writer) error {
 			}
 		} else {
 			log.Println("Waiting", im.Interval)
-			time.Sleep(im.Interval)
+			select {
+			case <-time.After(im.Interval):
+			case <-ctx.Done():
+			}
 		}
 
 	}
-
+	return nil
 }
 
-func (im *IMAP) Consume(writer *common.Writer) error {
+func (im *IMAP) Consume(ctx context.Context, writer *common.Writer) error {
 	if im.Interval == 0 {
 		im.Interval = 5 * time.Second
 	}
@@ -131,16 +137,18 @@ func (im *IMAP) Consume(writer *common.Writer) error {
 		if err != nil {
 			log.Println("Failed connect to email server due to", err)
 		} else {
-			err = im.onConection(conn, writer)
+			err = im.onConection(ctx, conn, writer)
 		}
 		if err != nil {
 			log.Println("Read error", err)
 		}
-		if im.Reconnect.Disable {
+		if im.Reconnect.Disable || ctx.Err() != nil {
 			return err
 		}
 		log.Println("Wait...")
-		im.Reconnect.Wait()
+		if im.Reconnect.Wait(ctx) != nil {
+			return nil
+		}
 	}
 }
 
@@ -152,8 +160,9 @@ type Config struct {
 func main() {
 	var app = kingpin.New("amqp-email-output", "Push data to AMQP broker and wait for response. Expects headers 'to' and 'subject'")
 	var (
-		quiet  = app.Flag("quiet", "Disable verbose logging").Short('q').Bool()
-		config = app.Flag("config", "Configuration .YAML file").Short('c').Default("email.yaml").ExistingFile()
+		quiet         = app.Flag("quiet", "Disable verbose logging").Short('q').Bool()
+		config        = app.Flag("config", "Configuration .YAML file").Short('c').Default("email.yaml").ExistingFile()
+		metricsListen = app.Flag("metrics-listen", "Address to expose Prometheus metrics on /metrics (ex: :9100)").String()
 	)
 	app.DefaultEnvars()
 	kingpin.MustParse(app.Parse(os.Args[1:]))
@@ -165,14 +174,16 @@ func main() {
 
 	var props Config
 	common.MustRead(*config, &props)
+	common.ServeMetrics(*metricsListen)
 	props.Writer.Init()
+	ctx := common.SignalContext()
 
 	go func() {
 		defer props.Writer.Close()
-		props.Mail.Consume(&props.Writer)
+		props.Mail.Consume(ctx, &props.Writer)
 	}()
 
-	err := props.Writer.Run()
+	err := props.Writer.Run(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
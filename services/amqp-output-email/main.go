@@ -43,15 +43,17 @@ type Config struct {
 }
 
 func (props *Config) consume(deliveries <-chan amqp.Delivery) error {
-
+	queue := props.Reader.Queue.RealName()
 	for msg := range deliveries {
 		if msg.Headers == nil {
+			common.CountNacked(queue)
 			msg.Nack(false, false)
 			log.Println("Message", msg.MessageId, "has no headers")
 			continue
 		}
 		to, ok := msg.Headers["to"]
 		if !ok {
+			common.CountNacked(queue)
 			msg.Nack(false, false)
 			log.Println("Message", msg.MessageId, "has no 'to' header")
 			continue
@@ -63,18 +65,21 @@ func (props *Config) consume(deliveries <-chan amqp.Delivery) error {
 		} else if toS, ok := to.([]string); ok {
 			dest = toS
 		} else {
+			common.CountNacked(queue)
 			msg.Nack(false, false)
 			log.Println("Message", msg.MessageId, "has non-string (or non-array-of-string) 'to' header")
 			continue
 		}
 		title, ok := msg.Headers["subject"]
 		if !ok {
+			common.CountNacked(queue)
 			msg.Nack(false, false)
 			log.Println("Message", msg.MessageId, "has no 'subject' header")
 			continue
 		}
 		titleS, ok := title.(string)
 		if !ok {
+			common.CountNacked(queue)
 			msg.Nack(false, false)
 			log.Println("Message", msg.MessageId, "has non-string 'subject' header")
 			continue
@@ -84,7 +89,15 @@ func (props *Config) consume(deliveries <-chan amqp.Delivery) error {
 		err := props.Mail.Send(dest, titleS, msg.Body, msg.ContentType, msg.ContentEncoding)
 		if err != nil {
 			log.Println("Failed send", err)
-			msg.Nack(false, true)
+			if props.Reader.Retry.Enabled() {
+				err = props.Reader.Fail(msg, err)
+				if err != nil {
+					return err
+				}
+			} else {
+				common.CountNacked(queue)
+				msg.Nack(false, true)
+			}
 			continue
 		}
 		log.Println("Sent")
@@ -93,6 +106,7 @@ func (props *Config) consume(deliveries <-chan amqp.Delivery) error {
 			log.Println("Failed ack", err)
 			return err
 		}
+		common.CountAcked(queue)
 
 	}
 	return nil
@@ -101,8 +115,9 @@ func (props *Config) consume(deliveries <-chan amqp.Delivery) error {
 func main() {
 	var app = kingpin.New("amqp-email-output", "Push data to AMQP broker and wait for response. Expects headers 'to' and 'subject'")
 	var (
-		quiet  = app.Flag("quiet", "Disable verbose logging").Short('q').Bool()
-		config = app.Flag("config", "Configuration .YAML file").Short('c').Default("email.yaml").ExistingFile()
+		quiet         = app.Flag("quiet", "Disable verbose logging").Short('q').Bool()
+		config        = app.Flag("config", "Configuration .YAML file").Short('c').Default("email.yaml").ExistingFile()
+		metricsListen = app.Flag("metrics-listen", "Address to expose Prometheus metrics on /metrics (ex: :9100)").String()
 	)
 	app.DefaultEnvars()
 	kingpin.MustParse(app.Parse(os.Args[1:]))
@@ -114,8 +129,9 @@ func main() {
 
 	var props Config
 	common.MustRead(*config, &props)
+	common.ServeMetrics(*metricsListen)
 
-	err := props.Reader.Consume(false, props.consume)
+	err := props.Reader.Consume(common.SignalContext(), false, props.consume)
 	if err != nil {
 		log.Fatal(err)
 	}